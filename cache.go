@@ -0,0 +1,176 @@
+package traefik_ip2region
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Cache part of the configuration
+type Cache struct {
+	// Size the number of addresses kept, 0 disables the cache
+	Size int `yaml:"size"`
+	// TTL how long a result is reused, e.g. 10m. Empty keeps it until it is evicted.
+	TTL string `yaml:"ttl,omitempty"`
+}
+
+// cacheStats the counters of the lookup cache in the status
+type cacheStats struct {
+	Size      int    `json:"size"`
+	Entries   int    `json:"entries"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// cacheEntry one cached lookup
+type cacheEntry struct {
+	ip      string
+	geo     geoResult
+	expires time.Time
+}
+
+// lookupCache a bounded LRU of lookup results by address. The results belong to
+// one generation of the databases and overlays, a reload of any of them clears it.
+type lookupCache struct {
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu         sync.Mutex
+	generation int
+	order      *list.List
+	entries    map[string]*list.Element
+	hits       uint64
+	misses     uint64
+	evictions  uint64
+}
+
+// newLookupCache returns nil when the cache is disabled
+func newLookupCache(cfg Cache) (*lookupCache, error) {
+	if cfg.Size < 0 {
+		return nil, fmt.Errorf("invalid cache size %d", cfg.Size)
+	}
+	if cfg.Size == 0 {
+		return nil, nil
+	}
+
+	c := &lookupCache{
+		size:    cfg.Size,
+		now:     time.Now,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+	if cfg.TTL != "" {
+		ttl, err := time.ParseDuration(cfg.TTL)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid cache ttl `%s`", cfg.TTL)
+		}
+		c.ttl = ttl
+	}
+	return c, nil
+}
+
+// get returns the cached result of ip, generation is the current one of the databases
+func (c *lookupCache) get(ip string, generation int) (geoResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sync(generation)
+	elem, ok := c.entries[ip]
+	if !ok {
+		c.misses++
+		return geoResult{}, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if c.ttl > 0 && !c.now().Before(entry.expires) {
+		c.remove(elem)
+		c.evictions++
+		c.misses++
+		return geoResult{}, false
+	}
+
+	c.order.MoveToFront(elem)
+	c.hits++
+	return entry.geo, true
+}
+
+// put stores the result of a lookup made against generation
+func (c *lookupCache) put(ip string, geo geoResult, generation int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sync(generation)
+	if generation != c.generation {
+		// a reload happened during the lookup
+		return
+	}
+
+	entry := &cacheEntry{ip: ip, geo: geo}
+	if c.ttl > 0 {
+		entry.expires = c.now().Add(c.ttl)
+	}
+	if elem, ok := c.entries[ip]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[ip] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+		c.evictions++
+	}
+}
+
+// sync drops every entry when the databases moved to a newer generation
+func (c *lookupCache) sync(generation int) {
+	if generation <= c.generation {
+		return
+	}
+	c.generation = generation
+	c.order.Init()
+	c.entries = map[string]*list.Element{}
+}
+
+func (c *lookupCache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).ip)
+}
+
+// stats returns the counters, nil when the cache is disabled
+func (c *lookupCache) stats() *cacheStats {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return &cacheStats{
+		Size:      c.size,
+		Entries:   c.order.Len(),
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
+
+// generation changes whenever a database or overlay of this instance is reloaded
+func (a *TraefikIp2Region) generation() int {
+	generation := a.overlay.generation()
+	for _, db := range []*dbEntry{a.db, a.db6} {
+		if db != nil {
+			generation += db.info().Version
+		}
+	}
+	for _, p := range a.providers {
+		if p.db != nil {
+			generation += p.db.info().Version
+		}
+		generation += p.overlay.generation()
+	}
+	return generation
+}
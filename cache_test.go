@@ -0,0 +1,121 @@
+package traefik_ip2region
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLookupCache(t *testing.T) {
+	c, err := newLookupCache(Cache{Size: 2, TTL: "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	geo := func(country string) geoResult {
+		return geoResult{data: []string{country, "0", "0", "0", "0"}}
+	}
+	c.put("1.1.1.1", geo("澳大利亚"), 0)
+	c.put("8.8.8.8", geo("美国"), 0)
+	if g, ok := c.get("1.1.1.1", 0); !ok || g.data[0] != "澳大利亚" {
+		t.Fatalf("cached result not returned: %+v", g)
+	}
+
+	// 8.8.8.8 is the least recently used
+	c.put("36.0.0.1", geo("中国"), 0)
+	if _, ok := c.get("8.8.8.8", 0); ok {
+		t.Error("least recently used entry not evicted")
+	}
+	if _, ok := c.get("1.1.1.1", 0); !ok {
+		t.Error("recently used entry evicted")
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.get("1.1.1.1", 0); ok {
+		t.Error("expired entry returned")
+	}
+
+	stats := c.stats()
+	if stats.Hits != 2 || stats.Misses != 2 || stats.Evictions != 2 || stats.Entries != 1 {
+		t.Errorf("invalid stats: %+v", stats)
+	}
+
+	// a lookup of an older generation finishing after a reload is dropped
+	c.put("1.1.1.1", geo("澳大利亚"), 0)
+	if _, ok := c.get("1.1.1.1", 1); ok {
+		t.Error("entry of an older generation returned")
+	}
+	c.put("8.8.8.8", geo("美国"), 0)
+	if c.stats().Entries != 0 {
+		t.Error("entry of an older generation stored")
+	}
+
+	for _, cfg := range []Cache{{Size: -1}, {Size: 1, TTL: "soon"}, {Size: 1, TTL: "-1s"}} {
+		if _, err := newLookupCache(cfg); err == nil {
+			t.Errorf("invalid config accepted: %+v", cfg)
+		}
+	}
+}
+
+func TestLookupCacheReload(t *testing.T) {
+	path := writeTestXdb(t, testRanges)
+
+	cfg := CreateConfig()
+	cfg.DBPath = path
+	cfg.ReloadInterval = "10ms"
+	cfg.StatusPath = "/.ip2region/status"
+	cfg.Cache = Cache{Size: 100}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := New(context.Background(), next, cfg, "demo-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := handler.(*TraefikIp2Region)
+	defer plugin.Close()
+
+	serve := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = "1.1.1.1:9999"
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		return req
+	}
+	serve()
+	assertHeader(t, serve(), "X-Ip2region-Country", "澳大利亚")
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/.ip2region/status", nil)
+	req.RemoteAddr = "127.0.0.1:9999"
+	handler.ServeHTTP(recorder, req)
+	var status pluginStatus
+	if err := json.NewDecoder(recorder.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Cache == nil || status.Cache.Hits != 1 || status.Cache.Misses != 1 {
+		t.Fatalf("invalid cache status: %+v", status.Cache)
+	}
+
+	buff := buildTestXdb(t, []testRange{{"1.1.1.0", "1.1.1.255", "新西兰|0|0|0|0"}})
+	if err := os.WriteFile(path, buff, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for plugin.db.info().Version < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("database was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertHeader(t, serve(), "X-Ip2region-Country", "新西兰")
+}
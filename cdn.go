@@ -0,0 +1,113 @@
+package traefik_ip2region
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// cdnPreset a CDN that puts the client address into a single header
+type cdnPreset struct {
+	header string
+	// published edge ranges, the header is only trusted from these
+	ranges []string
+}
+
+// cdnPresets by ipSource name.
+// Akamai has no preset, it does not publish a general list of edge ranges.
+var cdnPresets = map[string]cdnPreset{
+	"cloudflare": {
+		header: "CF-Connecting-IP",
+		// https://www.cloudflare.com/ips/
+		ranges: []string{
+			"173.245.48.0/20", "103.21.244.0/22", "103.22.200.0/22", "103.31.4.0/22",
+			"141.101.64.0/18", "108.162.192.0/18", "190.93.240.0/20", "188.114.96.0/20",
+			"197.234.240.0/22", "198.41.128.0/17", "162.158.0.0/15", "104.16.0.0/13",
+			"104.24.0.0/14", "172.64.0.0/13", "131.0.72.0/22",
+			"2400:cb00::/32", "2606:4700::/32", "2803:f800::/32", "2405:b500::/32",
+			"2405:8100::/32", "2a06:98c0::/29", "2c0f:f248::/32",
+		},
+	},
+	"fastly": {
+		header: "Fastly-Client-IP",
+		// https://api.fastly.com/public-ip-list
+		ranges: []string{
+			"23.235.32.0/20", "43.249.72.0/22", "103.244.50.0/24", "103.245.222.0/23",
+			"103.245.224.0/24", "104.156.80.0/20", "140.248.64.0/18", "140.248.128.0/17",
+			"146.75.0.0/17", "151.101.0.0/16", "157.52.64.0/18", "167.82.0.0/17",
+			"167.82.128.0/20", "167.82.160.0/20", "167.82.224.0/20", "172.111.64.0/18",
+			"185.31.16.0/22", "199.27.72.0/21", "199.232.0.0/16",
+			"2a04:4e40::/32", "2a04:4e42::/32",
+		},
+	},
+}
+
+// cdnSource reads the client address from the header of a CDN preset
+type cdnSource struct {
+	name   string
+	header string
+	ranges trustedProxies
+}
+
+// newCDNSource builds the source of a preset, rangesFile replaces the bundled ranges
+func newCDNSource(name, rangesFile string) (*cdnSource, error) {
+	preset, ok := cdnPresets[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown ipSource `%s`", name)
+	}
+
+	values := preset.ranges
+	if rangesFile != "" {
+		var err error
+		values, err = readRangesFile(rangesFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("ranges file `%s` has no ranges", rangesFile)
+	}
+
+	ranges, err := parseTrustedProxies(values)
+	if err != nil {
+		return nil, err
+	}
+	return &cdnSource{name: name, header: preset.header, ranges: ranges}, nil
+}
+
+// clientIP returns the header value when the request comes from the CDN, RemoteAddr otherwise
+func (c *cdnSource) clientIP(req *http.Request) string {
+	remoteAddr := remoteIP(req)
+	if !c.ranges.contains(remoteAddr) {
+		return remoteAddr
+	}
+
+	if ip := strings.TrimSpace(req.Header.Get(c.header)); ip != "" {
+		return ip
+	}
+	return remoteAddr
+}
+
+// readRangesFile reads one CIDR per line, empty lines and # comments are ignored
+func readRangesFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ranges file `%s`: %s", path, err)
+	}
+	defer f.Close()
+
+	var ranges []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			ranges = append(ranges, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read ranges file `%s`: %s", path, err)
+	}
+	return ranges, nil
+}
@@ -0,0 +1,52 @@
+package traefik_ip2region
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCDNSourceCloudflare(t *testing.T) {
+	cdn, err := newCDNSource("cloudflare", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "172.64.0.1:9999"
+	req.Header.Set("CF-Connecting-IP", "223.5.5.5")
+	if ip := cdn.clientIP(req); ip != "223.5.5.5" {
+		t.Errorf("invalid client ip: %s", ip)
+	}
+
+	// bypassing the CDN
+	req.RemoteAddr = "1.1.1.1:9999"
+	if ip := cdn.clientIP(req); ip != "1.1.1.1" {
+		t.Errorf("invalid client ip: %s", ip)
+	}
+}
+
+func TestCDNSourceRangesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ranges.txt")
+	if err := os.WriteFile(path, []byte("# edge\n10.0.0.0/8\n\n2001:db8::/32 # v6\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newCDNSource("akamai", path); err == nil {
+		t.Fatal("expected an error for an unknown preset")
+	}
+
+	cdn, err := newCDNSource("cloudflare", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "[2001:db8::1]:9999"
+	req.Header.Set("CF-Connecting-IP", "8.8.8.8")
+	if ip := cdn.clientIP(req); ip != "8.8.8.8" {
+		t.Errorf("invalid client ip: %s", ip)
+	}
+}
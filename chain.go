@@ -0,0 +1,158 @@
+package traefik_ip2region
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// defaultChainHeader is used for the chain when no header is configured
+const defaultChainHeader = "X-Forwarded-For"
+
+// maxChainHops bounds the lookups per request, the client controls the length of the header.
+// The hops closest to RemoteAddr are kept.
+const maxChainHops = 10
+
+// chainHop a looked up address of the forwarding chain
+type chainHop struct {
+	ip string
+	geoResult
+}
+
+// chainHeader returns the header the forwarding chain is read from.
+// Of the clientIpSources the first one that carries a chain wins, a single value header
+// such as X-Real-IP only when no source does.
+func (a *TraefikIp2Region) chainHeader() string {
+	if a.ipFromHeader != "" {
+		return a.ipFromHeader
+	}
+	for _, s := range a.sources {
+		switch s.Mode {
+		case sourceModeTrusted, sourceModeLast, sourceModeForwarded:
+			return s.Header
+		}
+	}
+	for _, s := range a.sources {
+		if s.Header != "" {
+			return s.Header
+		}
+	}
+	return defaultChainHeader
+}
+
+// lookupChain looks up every untrusted hop of the forwarding chain and RemoteAddr, left to right.
+// Malformed hops and duplicates are skipped, at most maxChainHops hops are looked up.
+func (a *TraefikIp2Region) lookupChain(req *http.Request) []chainHop {
+	chain := append(forwardedChain(req, a.chainHeader()), remoteIP(req))
+
+	var hops []chainHop
+	seen := map[string]bool{}
+	for i := len(chain) - 1; i >= 0 && len(hops) < maxChainHops; i-- {
+		addr, err := normalizeIP(chain[i])
+		if err != nil {
+			continue
+		}
+		ip, _ := unwrapIPv4(addr.String())
+		if seen[ip] || a.trusted.contains(ip) || (a.cdn != nil && a.cdn.ranges.contains(ip)) {
+			continue
+		}
+		seen[ip] = true
+
+		hops = append(hops, chainHop{ip: ip, geoResult: a.lookup(ip)})
+	}
+
+	// back to left to right
+	for i, j := 0, len(hops)-1; i < j; i, j = i+1, j-1 {
+		hops[i], hops[j] = hops[j], hops[i]
+	}
+	return hops
+}
+
+// chain mismatch actions
+const (
+	mismatchIgnore = "ignore"
+	mismatchTag    = "tag"
+	mismatchBlock  = "block"
+)
+
+// geo fields that can be compared, by index of 国家|区域|省份|城市|ISP
+var mismatchFields = map[string]int{
+	"country":  0,
+	"province": 2,
+	"city":     3,
+	"isp":      4,
+}
+
+// ChainMismatch part of the configuration
+type ChainMismatch struct {
+	// Action ignore (default), tag or block
+	Action string `yaml:"action,omitempty"`
+	// Fields compared across the chain, country by default
+	Fields []string `yaml:"fields,omitempty"`
+}
+
+// mismatchDetector finds forwarding chains whose hops disagree on geo data
+type mismatchDetector struct {
+	action string
+	fields []string
+}
+
+// newMismatchDetector returns nil when detection is disabled
+func newMismatchDetector(cfg ChainMismatch) (*mismatchDetector, error) {
+	switch cfg.Action {
+	case "", mismatchIgnore:
+		return nil, nil
+	case mismatchTag, mismatchBlock:
+	default:
+		return nil, fmt.Errorf("unknown chainMismatch action `%s`", cfg.Action)
+	}
+
+	fields := cfg.Fields
+	if len(fields) == 0 {
+		fields = []string{"country"}
+	}
+	for _, f := range fields {
+		if _, ok := mismatchFields[f]; !ok {
+			return nil, fmt.Errorf("unknown chainMismatch field `%s`", f)
+		}
+	}
+	return &mismatchDetector{action: cfg.Action, fields: fields}, nil
+}
+
+// detect compares the last untrusted hop, usually RemoteAddr, with every other public hop
+// and returns the fields that disagree. Empty and `0` values are not compared.
+func (d *mismatchDetector) detect(hops []chainHop) []string {
+	if d == nil {
+		return nil
+	}
+
+	var public []chainHop
+	for _, hop := range hops {
+		if isPublicIP(hop.ip) {
+			public = append(public, hop)
+		}
+	}
+	if len(public) < 2 {
+		return nil
+	}
+
+	reference := public[len(public)-1]
+	var mismatched []string
+	for _, f := range d.fields {
+		i := mismatchFields[f]
+		if !knownValue(reference.data[i]) {
+			continue
+		}
+		for _, hop := range public[:len(public)-1] {
+			if knownValue(hop.data[i]) && hop.data[i] != reference.data[i] {
+				mismatched = append(mismatched, f)
+				break
+			}
+		}
+	}
+	return mismatched
+}
+
+// knownValue reports whether v carries geo data, ip2region uses 0 for unknown
+func knownValue(v string) bool {
+	return v != "" && v != "0"
+}
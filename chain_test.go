@@ -0,0 +1,130 @@
+package traefik_ip2region
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStrictChain(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	for strict, status := range map[bool]int{false: http.StatusOK, true: http.StatusForbidden} {
+		cfg := CreateConfig()
+		cfg.DBPath = writeTestXdb(t, testRanges)
+		cfg.IpFromHeader = "X-Forwarded-For"
+		cfg.TrustedProxies = []string{"10.0.0.0/8"}
+		cfg.Ban.Enabled = true
+		cfg.Ban.Country = []string{"中国"}
+		cfg.StrictChain = strict
+		cfg.Headers.ChainCountries = "X-Ip2region-Chain-Countries"
+
+		handler, err := New(context.Background(), next, cfg, "demo-plugin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// a banned client behind an open proxy
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = "10.0.0.1:9999"
+		req.Header.Set("X-Forwarded-For", "223.5.5.5, 1.1.1.1, 10.0.0.2")
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Result().StatusCode != status {
+			t.Errorf("strict=%t: invalid status code: %d", strict, recorder.Result().StatusCode)
+		}
+		assertHeader(t, req, "X-Ip2region-Country", "澳大利亚")
+		if strict {
+			assertHeader(t, req, "X-Ip2region-Chain-Countries", "中国,澳大利亚")
+		}
+		handler.(*TraefikIp2Region).Close()
+	}
+}
+
+func TestStrictChainSources(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DBPath = writeTestXdb(t, testRanges)
+	cfg.TrustedProxies = []string{"10.0.0.0/8"}
+	cfg.ClientIPSources = []ClientIPSource{
+		{Header: "X-Real-IP"},
+		{Header: "X-Forwarded-For", Mode: sourceModeTrusted},
+		{Mode: sourceModeRemoteAddr},
+	}
+	cfg.StrictChain = true
+	cfg.Headers.ChainCountries = "X-Ip2region-Chain-Countries"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := New(context.Background(), next, cfg, "demo-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.(*TraefikIp2Region).Close()
+
+	// the chain comes from X-Forwarded-For, not the single value X-Real-IP
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "10.0.0.1:9999"
+	req.Header.Set("X-Real-IP", "1.1.1.1")
+	req.Header.Set("X-Forwarded-For", "223.5.5.5, 8.8.8.8, 10.0.0.2")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, "X-Ip2region-Chain-Countries", "中国,美国")
+
+	// only the hops closest to RemoteAddr are looked up
+	hops := make([]string, 2*maxChainHops)
+	for i := range hops {
+		hops[i] = fmt.Sprintf("36.0.0.%d", i+1)
+	}
+	hops[len(hops)-1] = "1.1.1.1"
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "10.0.0.1:9999"
+	req.Header.Set("X-Forwarded-For", strings.Join(hops, ", "))
+	chain := handler.(*TraefikIp2Region).lookupChain(req)
+	if len(chain) != maxChainHops || chain[len(chain)-1].ip != "1.1.1.1" {
+		t.Errorf("invalid chain of %d hops, last %+v", len(chain), chain[len(chain)-1])
+	}
+}
+
+func TestChainMismatch(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	tests := []struct {
+		action string
+		xff    string
+		status int
+		header string
+	}{
+		{mismatchTag, "1.1.1.1", http.StatusOK, "country"},
+		{mismatchBlock, "1.1.1.1", http.StatusForbidden, "country"},
+		{mismatchBlock, "223.5.5.5", http.StatusOK, ""},
+		// private hops are not compared
+		{mismatchBlock, "192.168.1.1", http.StatusOK, ""},
+	}
+
+	for _, test := range tests {
+		cfg := CreateConfig()
+		cfg.DBPath = writeTestXdb(t, testRanges)
+		cfg.IpFromHeader = "X-Forwarded-For"
+		cfg.ChainMismatch.Action = test.action
+		cfg.Headers.ChainMismatch = "X-Ip2region-Chain-Mismatch"
+
+		handler, err := New(context.Background(), next, cfg, "demo-plugin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = "36.0.0.1:9999"
+		req.Header.Set("X-Forwarded-For", test.xff)
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Result().StatusCode != test.status {
+			t.Errorf("%s %s: invalid status code: %d", test.action, test.xff, recorder.Result().StatusCode)
+		}
+		assertHeader(t, req, "X-Ip2region-Chain-Mismatch", test.header)
+		handler.(*TraefikIp2Region).Close()
+	}
+}
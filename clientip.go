@@ -0,0 +1,281 @@
+package traefik_ip2region
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// trustedProxies the networks whose forwarding headers are believed
+type trustedProxies []netip.Prefix
+
+// parseTrustedProxies accepts CIDRs and single addresses
+func parseTrustedProxies(values []string) (trustedProxies, error) {
+	var trusted trustedProxies
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		if strings.Contains(v, "/") {
+			prefix, err := netip.ParsePrefix(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy `%s`: %s", v, err)
+			}
+			trusted = append(trusted, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy `%s`: %s", v, err)
+		}
+		trusted = append(trusted, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return trusted, nil
+}
+
+// contains reports whether ipStr belongs to a trusted proxy
+func (t trustedProxies) contains(ipStr string) bool {
+	addr, err := normalizeIP(ipStr)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range t {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// client ip source modes
+const (
+	sourceModeFirst      = "first"
+	sourceModeLast       = "last"
+	sourceModeTrusted    = "trusted"
+	sourceModeForwarded  = "forwarded"
+	sourceModeRemoteAddr = "remoteAddr"
+)
+
+// actions for a malformed client address
+const (
+	invalidIPPass       = "pass"
+	invalidIPRemoteAddr = "remoteAddr"
+	invalidIPBlock      = "block"
+)
+
+// ClientIPSource one entry of the client IP fallback chain
+type ClientIPSource struct {
+	// Header to read, not used by the remoteAddr mode
+	Header string `yaml:"header,omitempty"`
+	// Mode first (default), last, trusted, forwarded or remoteAddr
+	Mode string `yaml:"mode,omitempty"`
+}
+
+// validate checks the mode and header combination
+func (s ClientIPSource) validate() error {
+	switch s.Mode {
+	case "", sourceModeFirst, sourceModeLast, sourceModeTrusted, sourceModeForwarded:
+		if s.Header == "" {
+			return fmt.Errorf("client ip source with mode `%s` needs a header", s.Mode)
+		}
+	case sourceModeRemoteAddr:
+	default:
+		return fmt.Errorf("unknown client ip source mode `%s`", s.Mode)
+	}
+	return nil
+}
+
+// name identifies the source in the debug header
+func (s ClientIPSource) name() string {
+	if s.Mode == sourceModeRemoteAddr {
+		return sourceModeRemoteAddr
+	}
+	return s.Header
+}
+
+// candidate returns the address this source claims, or "" when it has none
+func (s ClientIPSource) candidate(req *http.Request, remoteAddr string, trusted trustedProxies) string {
+	switch s.Mode {
+	case sourceModeRemoteAddr:
+		return remoteAddr
+	case sourceModeTrusted:
+		if !trusted.contains(remoteAddr) {
+			return ""
+		}
+		return trusted.walk(forwardedChain(req, s.Header), "")
+	case sourceModeForwarded:
+		chain := forwardedFor(req, s.Header)
+		if len(chain) == 0 {
+			return ""
+		}
+		if len(trusted) > 0 {
+			if !trusted.contains(remoteAddr) {
+				return ""
+			}
+			return trusted.walk(chain, "")
+		}
+		return chain[0]
+	case sourceModeLast:
+		chain := forwardedChain(req, s.Header)
+		if len(chain) == 0 {
+			return ""
+		}
+		return chain[len(chain)-1]
+	default:
+		chain := forwardedChain(req, s.Header)
+		if len(chain) == 0 {
+			return ""
+		}
+		return chain[0]
+	}
+}
+
+// resolveClientIP walks sources in order, the first valid public address wins.
+// RemoteAddr is used when no source yields one.
+func resolveClientIP(req *http.Request, sources []ClientIPSource, trusted trustedProxies) (string, string) {
+	remoteAddr := remoteIP(req)
+	for _, s := range sources {
+		if ip := s.candidate(req, remoteAddr, trusted); isPublicIP(ip) {
+			return ip, s.name()
+		}
+	}
+	return remoteAddr, sourceModeRemoteAddr
+}
+
+// isPublicIP reports whether ip is a valid, globally routable address,
+// none of the special purpose ranges the reserved classifier labels
+func isPublicIP(ip string) bool {
+	addr, err := normalizeIP(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() {
+		return false
+	}
+	_, reserved := longestMatch(reservedRanges, addr)
+	return !reserved
+}
+
+// remoteIP returns the host part of RemoteAddr
+func remoteIP(req *http.Request) string {
+	remoteAddr := req.RemoteAddr
+	tmp, _, err := net.SplitHostPort(remoteAddr)
+	if err == nil {
+		remoteAddr = tmp
+	}
+	return remoteAddr
+}
+
+func getClientIP(req *http.Request, ipFromHeader string, trusted trustedProxies) string {
+	// If ipFromHeader is not present or retrieval is not enabled, fallback to RemoteAddr
+	remoteAddr := remoteIP(req)
+
+	if ipFromHeader == "" {
+		return remoteAddr
+	}
+
+	// without trusted proxies the first entry of the header is used as is
+	if len(trusted) == 0 {
+		chain := forwardedChain(req, ipFromHeader)
+		if len(chain) > 0 {
+			return chain[0]
+		}
+		return remoteAddr
+	}
+
+	// the header is only honoured when it was set by a trusted proxy
+	if !trusted.contains(remoteAddr) {
+		return remoteAddr
+	}
+
+	return trusted.walk(forwardedChain(req, ipFromHeader), remoteAddr)
+}
+
+// forwardedChain returns all hops of a forwarding header in order.
+// `Forwarded` is parsed as RFC 7239, any other header as a comma separated list.
+func forwardedChain(req *http.Request, header string) []string {
+	if strings.EqualFold(header, forwardedHeader) {
+		return forwardedFor(req, header)
+	}
+
+	var chain []string
+	for _, value := range req.Header.Values(header) {
+		for _, ip := range strings.Split(value, ",") {
+			ip = strings.TrimSpace(ip)
+			if ip != "" {
+				chain = append(chain, ip)
+			}
+		}
+	}
+	return chain
+}
+
+// walk goes through chain from right to left and stops at the first untrusted hop.
+// When every hop is trusted the leftmost one is the client.
+func (t trustedProxies) walk(chain []string, remoteAddr string) string {
+	client := remoteAddr
+	for i := len(chain) - 1; i >= 0; i-- {
+		client = chain[i]
+		if !t.contains(client) {
+			break
+		}
+	}
+	return client
+}
+
+// normalizeIP parses a claimed client address into its canonical form.
+// Surrounding quotes, brackets, ports and IPv6 zones are stripped.
+func normalizeIP(s string) (netip.Addr, error) {
+	host := strings.TrimSpace(s)
+	if len(host) >= 2 && host[0] == '"' && host[len(host)-1] == '"' {
+		host = strings.TrimSpace(host[1 : len(host)-1])
+	}
+
+	port := ""
+	switch {
+	case strings.HasPrefix(host, "["):
+		end := strings.IndexByte(host, ']')
+		if end < 0 {
+			return netip.Addr{}, fmt.Errorf("invalid ip address `%s`", s)
+		}
+		rest := host[end+1:]
+		if rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return netip.Addr{}, fmt.Errorf("invalid ip address `%s`", s)
+			}
+			port = rest[1:]
+			if port == "" {
+				return netip.Addr{}, fmt.Errorf("invalid port in `%s`", s)
+			}
+		}
+		host = host[1:end]
+	case strings.Count(host, ":") == 1:
+		// IPv4 with a port
+		host, port, _ = strings.Cut(host, ":")
+		if port == "" {
+			return netip.Addr{}, fmt.Errorf("invalid port in `%s`", s)
+		}
+	}
+
+	if port != "" {
+		n, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || n == 0 {
+			return netip.Addr{}, fmt.Errorf("invalid port in `%s`", s)
+		}
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid ip address `%s`", s)
+	}
+	return addr.WithZone(""), nil
+}
@@ -0,0 +1,190 @@
+package traefik_ip2region
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetClientIPTrustedProxies(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     []string
+		expected   string
+	}{
+		{"untrusted remote ignores header", "1.1.1.1:9999", []string{"8.8.8.8"}, "1.1.1.1"},
+		{"trusted remote", "10.0.0.1:9999", []string{"8.8.8.8"}, "8.8.8.8"},
+		{"spoofed first hop", "10.0.0.1:9999", []string{"1.1.1.1, 8.8.8.8"}, "8.8.8.8"},
+		{"skip trusted hops", "10.0.0.1:9999", []string{"1.1.1.1, 8.8.8.8, 192.168.1.1, 10.1.1.1"}, "8.8.8.8"},
+		{"multiple header lines", "10.0.0.1:9999", []string{"1.1.1.1", "8.8.8.8, 10.2.2.2"}, "8.8.8.8"},
+		{"all hops trusted", "10.0.0.1:9999", []string{"10.3.3.3, 10.2.2.2"}, "10.3.3.3"},
+		{"no header", "10.0.0.1:9999", nil, "10.0.0.1"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = test.remoteAddr
+		for _, v := range test.header {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+
+		if ip := getClientIP(req, "X-Forwarded-For", trusted); ip != test.expected {
+			t.Errorf("%s: got %s, want %s", test.name, ip, test.expected)
+		}
+	}
+}
+
+func TestGetClientIPWithoutTrustedProxies(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "10.0.0.1:9999"
+	req.Header.Set("X-Forwarded-For", "1.1.1.1, 8.8.8.8")
+
+	if ip := getClientIP(req, "X-Forwarded-For", nil); ip != "1.1.1.1" {
+		t.Errorf("invalid client ip: %s", ip)
+	}
+}
+
+func TestParseTrustedProxiesInvalid(t *testing.T) {
+	if _, err := parseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("expected an error for an invalid CIDR")
+	}
+}
+
+func TestResolveClientIPFallback(t *testing.T) {
+	sources := []ClientIPSource{
+		{Header: "X-Real-IP", Mode: sourceModeFirst},
+		{Header: "X-Forwarded-For", Mode: sourceModeLast},
+		{Mode: sourceModeRemoteAddr},
+	}
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		ip      string
+		source  string
+	}{
+		{"first source", map[string]string{"X-Real-IP": "1.1.1.1", "X-Forwarded-For": "8.8.8.8"}, "1.1.1.1", "X-Real-IP"},
+		{"private address skipped", map[string]string{"X-Real-IP": "10.0.0.1", "X-Forwarded-For": "1.1.1.1, 8.8.8.8"}, "8.8.8.8", "X-Forwarded-For"},
+		{"cgnat address skipped", map[string]string{"X-Real-IP": "100.64.0.1", "X-Forwarded-For": "8.8.8.8"}, "8.8.8.8", "X-Forwarded-For"},
+		{"documentation address skipped", map[string]string{"X-Real-IP": "203.0.113.7", "X-Forwarded-For": "8.8.8.8"}, "8.8.8.8", "X-Forwarded-For"},
+		{"benchmarking address skipped", map[string]string{"X-Real-IP": "198.18.0.1", "X-Forwarded-For": "8.8.8.8"}, "8.8.8.8", "X-Forwarded-For"},
+		{"class e address skipped", map[string]string{"X-Real-IP": "240.0.0.1", "X-Forwarded-For": "8.8.8.8"}, "8.8.8.8", "X-Forwarded-For"},
+		{"garbage skipped", map[string]string{"X-Real-IP": "garbage"}, "223.5.5.5", sourceModeRemoteAddr},
+		{"no headers", nil, "223.5.5.5", sourceModeRemoteAddr},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = "223.5.5.5:9999"
+		for k, v := range test.headers {
+			req.Header.Set(k, v)
+		}
+
+		ip, source := resolveClientIP(req, sources, nil)
+		if ip != test.ip || source != test.source {
+			t.Errorf("%s: got %s from %s, want %s from %s", test.name, ip, source, test.ip, test.source)
+		}
+	}
+}
+
+func TestClientIPSourcesHeader(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DBPath = writeTestXdb(t, testRanges)
+	cfg.Headers.IPSource = "X-Ip2region-Source"
+	cfg.ClientIPSources = []ClientIPSource{{Header: "Forwarded", Mode: sourceModeForwarded}, {Mode: sourceModeRemoteAddr}}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := New(context.Background(), next, cfg, "demo-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.(*TraefikIp2Region).Close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "10.0.0.1:9999"
+	req.Header.Set("Forwarded", "for=1.1.1.1;proto=https")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, "X-Ip2region-Source", "Forwarded")
+	assertHeader(t, req, "X-Ip2region-Country", "澳大利亚")
+}
+
+func TestClientIPSourcesInvalid(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DBPath = writeTestXdb(t, testRanges)
+	cfg.ClientIPSources = []ClientIPSource{{Mode: "nearest"}}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	if _, err := New(context.Background(), next, cfg, "demo-plugin"); err == nil {
+		t.Fatal("expected an error for an unknown mode")
+	}
+}
+
+func TestNormalizeIP(t *testing.T) {
+	tests := map[string]string{
+		"1.2.3.4":             "1.2.3.4",
+		" 1.2.3.4:5678 ":      "1.2.3.4",
+		`"1.2.3.4"`:           "1.2.3.4",
+		"[2001:db8::1]:443":   "2001:db8::1",
+		"[2001:db8::1]":       "2001:db8::1",
+		"2001:DB8::1":         "2001:db8::1",
+		"fe80::1%eth0":        "fe80::1",
+		"[fe80::1%eth0]:8080": "fe80::1",
+	}
+	for in, expected := range tests {
+		addr, err := normalizeIP(in)
+		if err != nil {
+			t.Errorf("normalizeIP(%s): %s", in, err)
+			continue
+		}
+		if addr.String() != expected {
+			t.Errorf("normalizeIP(%s) = %s, want %s", in, addr, expected)
+		}
+	}
+
+	for _, in := range []string{"", "garbage", "1.2.3.4:", "1.2.3.4:99999", "[2001:db8::1", "[2001:db8::1]443", "1.2.3", "unknown"} {
+		if addr, err := normalizeIP(in); err == nil {
+			t.Errorf("normalizeIP(%s) = %s, want an error", in, addr)
+		}
+	}
+}
+
+func TestInvalidIPAction(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	for action, status := range map[string]int{invalidIPPass: http.StatusOK, invalidIPBlock: http.StatusForbidden, invalidIPRemoteAddr: http.StatusOK} {
+		cfg := CreateConfig()
+		cfg.DBPath = writeTestXdb(t, testRanges)
+		cfg.IpFromHeader = "X-Real-IP"
+		cfg.InvalidIPAction = action
+
+		handler, err := New(context.Background(), next, cfg, "demo-plugin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = "1.1.1.1:9999"
+		req.Header.Set("X-Real-IP", "not-an-ip")
+		handler.ServeHTTP(recorder, req)
+
+		plugin := handler.(*TraefikIp2Region)
+		if recorder.Result().StatusCode != status {
+			t.Errorf("%s: invalid status code: %d", action, recorder.Result().StatusCode)
+		}
+		if plugin.InvalidIPs() != 1 {
+			t.Errorf("%s: invalid ip not counted", action)
+		}
+		if action == invalidIPRemoteAddr {
+			assertHeader(t, req, "X-Ip2region-Country", "澳大利亚")
+		}
+		plugin.Close()
+	}
+}
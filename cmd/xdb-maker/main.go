@@ -0,0 +1,407 @@
+// Command xdb-maker builds an ip2region v2 xdb file from ip2region source data or CSV ranges.
+//
+// Text input has one startIP|endIP|country|region|province|city|isp range per line.
+// CSV input has either startIP,endIP,country,region,province,city,isp
+// or cidr,country,region,province,city,isp rows. Empty lines and lines starting
+// with # are skipped in both formats.
+//
+// Every range needs exactly the five region fields country|region|province|city|isp,
+// use 0 for an unknown one. Overlapping ranges are an error. Gaps are an error as well unless -allow-gaps is
+// given, they are then written as empty regions so lookups return nothing.
+// Every range is looked up in the built file before it is written.
+//
+// Usage:
+//
+//	xdb-maker -src ip.merge.txt -dst ip2region.xdb
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lionsoul2014/ip2region/binding/golang/xdb"
+)
+
+// input formats
+const (
+	formatText = "text"
+	formatCSV  = "csv"
+)
+
+// xdbStructure20 the header version written, the one xdb.Searcher reads
+const xdbStructure20 = 2
+
+// maxRegionSize the region length is stored in two bytes
+const maxRegionSize = 0xFFFF
+
+// regionFields country|region|province|city|isp, the middleware ignores regions with fewer
+const regionFields = 5
+
+// segment a range of addresses with the same region
+type segment struct {
+	start  uint32
+	end    uint32
+	region string
+	// line in the source, 0 for filled gaps
+	line int
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("xdb-maker: ")
+
+	src := flag.String("src", "", "source file, ip2region text or CSV")
+	dst := flag.String("dst", "ip2region.xdb", "xdb file to write")
+	format := flag.String("format", "", "text or csv, detected from the extension of src when empty")
+	allowGaps := flag.Bool("allow-gaps", false, "write unlisted addresses as empty regions instead of failing")
+	flag.Parse()
+
+	if *src == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *format == "" {
+		*format = formatText
+		if strings.EqualFold(filepath.Ext(*src), ".csv") {
+			*format = formatCSV
+		}
+	}
+
+	if err := run(*src, *dst, *format, *allowGaps); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(src, dst, format string, allowGaps bool) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	segments, err := readSegments(f, format)
+	if err != nil {
+		return fmt.Errorf("%s: %s", src, err)
+	}
+
+	segments, gaps, err := checkSegments(segments, allowGaps)
+	if err != nil {
+		return fmt.Errorf("%s: %s", src, err)
+	}
+
+	content, err := build(segments, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := verify(content, segments); err != nil {
+		return fmt.Errorf("verification of the built file failed: %s", err)
+	}
+
+	if err := writeFileAtomic(dst, content); err != nil {
+		return err
+	}
+	log.Printf("wrote %s: %d ranges, %d gaps, %d bytes", dst, len(segments)-gaps, gaps, len(content))
+	return nil
+}
+
+// readSegments parses the source in the given format
+func readSegments(r io.Reader, format string) ([]segment, error) {
+	switch format {
+	case formatText:
+		return readText(r)
+	case formatCSV:
+		return readCSV(r)
+	default:
+		return nil, fmt.Errorf("unknown format `%s`", format)
+	}
+}
+
+// readText parses startIP|endIP|country|region|province|city|isp lines
+func readText(r io.Reader) ([]segment, error) {
+	var segments []segment
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		parts := strings.Split(text, "|")
+		if len(parts) < 3 {
+			return nil, fmt.Errorf("line %d: expected startIP|endIP|region", line)
+		}
+		s, err := newSegment(parts[0], parts[1], parts[2:], line)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, s)
+	}
+	return segments, scanner.Err()
+}
+
+// readCSV parses startIP,endIP,fields... or cidr,fields... rows
+func readCSV(r io.Reader) ([]segment, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var segments []segment
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return segments, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		if strings.Contains(record[0], "/") {
+			prefix, err := netip.ParsePrefix(strings.TrimSpace(record[0]))
+			if err != nil || !prefix.Addr().Is4() {
+				return nil, fmt.Errorf("line %d: invalid IPv4 cidr `%s`", line, record[0])
+			}
+			prefix = prefix.Masked()
+			start := prefix.Addr()
+			end := lastAddr(prefix)
+			s, err := newSegment(start.String(), end.String(), record[1:], line)
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, s)
+			continue
+		}
+
+		if len(record) < 3 {
+			return nil, fmt.Errorf("line %d: expected startIP,endIP,region or cidr,region", line)
+		}
+		s, err := newSegment(record[0], record[1], record[2:], line)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, s)
+	}
+}
+
+// lastAddr returns the last address of prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	ip := binary.BigEndian.Uint32(prefix.Addr().AsSlice())
+	ip |= uint32(1)<<(32-prefix.Bits()) - 1
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], ip)
+	return netip.AddrFrom4(b)
+}
+
+// newSegment validates one range, the fields become the region joined by |
+func newSegment(start, end string, fields []string, line int) (segment, error) {
+	sip, err := parseIPv4(start)
+	if err != nil {
+		return segment{}, fmt.Errorf("line %d: %s", line, err)
+	}
+	eip, err := parseIPv4(end)
+	if err != nil {
+		return segment{}, fmt.Errorf("line %d: %s", line, err)
+	}
+	if eip < sip {
+		return segment{}, fmt.Errorf("line %d: end ip %s before start ip %s", line, end, start)
+	}
+
+	if len(fields) != regionFields {
+		return segment{}, fmt.Errorf("line %d: expected %d region fields country|region|province|city|isp, got %d",
+			line, regionFields, len(fields))
+	}
+	for i, f := range fields {
+		fields[i] = strings.TrimSpace(f)
+		if strings.Contains(fields[i], "|") {
+			return segment{}, fmt.Errorf("line %d: field `%s` contains |", line, f)
+		}
+	}
+	region := strings.Join(fields, "|")
+	if len(region) > maxRegionSize {
+		return segment{}, fmt.Errorf("line %d: region longer than %d bytes", line, maxRegionSize)
+	}
+	return segment{start: sip, end: eip, region: region, line: line}, nil
+}
+
+// parseIPv4 the xdb v2 format holds IPv4 only
+func parseIPv4(s string) (uint32, error) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid ip `%s`", s)
+	}
+	addr = addr.Unmap()
+	if !addr.Is4() {
+		return 0, fmt.Errorf("`%s` is not an IPv4 address, the xdb v2 format holds IPv4 only", s)
+	}
+	return binary.BigEndian.Uint32(addr.AsSlice()), nil
+}
+
+// checkSegments sorts the ranges and rejects overlaps. Gaps are rejected, or filled
+// with empty regions when allowed, so the result covers the whole IPv4 space.
+// Also returns the number of filled gaps.
+func checkSegments(segments []segment, allowGaps bool) ([]segment, int, error) {
+	if len(segments) == 0 {
+		return nil, 0, fmt.Errorf("no ranges")
+	}
+
+	sort.SliceStable(segments, func(i, j int) bool {
+		return segments[i].start < segments[j].start
+	})
+
+	var (
+		covered []segment
+		gaps    []string
+		next    uint64
+	)
+	for i, s := range segments {
+		if i > 0 && uint64(s.start) < next {
+			prev := segments[i-1]
+			return nil, 0, fmt.Errorf("line %d: %s-%s overlaps line %d: %s-%s",
+				s.line, ipString(s.start), ipString(s.end), prev.line, ipString(prev.start), ipString(prev.end))
+		}
+		if uint64(s.start) > next {
+			gaps = append(gaps, ipString(uint32(next))+"-"+ipString(s.start-1))
+			covered = append(covered, segment{start: uint32(next), end: s.start - 1})
+		}
+		covered = append(covered, s)
+		next = uint64(s.end) + 1
+	}
+	if next <= 0xFFFFFFFF {
+		gaps = append(gaps, ipString(uint32(next))+"-255.255.255.255")
+		covered = append(covered, segment{start: uint32(next), end: 0xFFFFFFFF})
+	}
+
+	if len(gaps) > 0 && !allowGaps {
+		if len(gaps) > 10 {
+			gaps = append(gaps[:10], fmt.Sprintf("and %d more", len(gaps)-10))
+		}
+		return nil, 0, fmt.Errorf("addresses not covered, use -allow-gaps to leave them empty: %s",
+			strings.Join(gaps, ", "))
+	}
+	return covered, len(gaps), nil
+}
+
+func ipString(ip uint32) string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], ip)
+	return netip.AddrFrom4(b).String()
+}
+
+// build writes header, vector index, regions and segment index.
+// Segments are split at /16 boundaries so each vector index cell covers its own blocks,
+// the end pointer of a cell is exclusive like in the upstream maker.
+func build(segments []segment, createdAt time.Time) ([]byte, error) {
+	vectorIndexLength := xdb.VectorIndexRows * xdb.VectorIndexCols * xdb.VectorIndexSize
+	buf := make([]byte, xdb.HeaderInfoLength+vectorIndexLength)
+
+	// regions, each distinct value once
+	regionPtr := map[string]uint32{}
+	for _, s := range segments {
+		if s.region == "" {
+			continue
+		}
+		if _, ok := regionPtr[s.region]; !ok {
+			regionPtr[s.region] = uint32(len(buf))
+			buf = append(buf, s.region...)
+		}
+	}
+
+	startPtr := uint32(len(buf))
+	block := make([]byte, xdb.SegmentIndexBlockSize)
+	for _, s := range split(segments) {
+		if uint64(len(buf))+xdb.SegmentIndexBlockSize > 0xFFFFFFFF {
+			return nil, fmt.Errorf("xdb file larger than 4 GiB")
+		}
+		ptr := uint32(len(buf))
+		binary.LittleEndian.PutUint32(block, s.start)
+		binary.LittleEndian.PutUint32(block[4:], s.end)
+		binary.LittleEndian.PutUint16(block[8:], uint16(len(s.region)))
+		binary.LittleEndian.PutUint32(block[10:], regionPtr[s.region])
+		buf = append(buf, block...)
+
+		idx := xdb.HeaderInfoLength + int(s.start>>24)*xdb.VectorIndexCols*xdb.VectorIndexSize +
+			int((s.start>>16)&0xFF)*xdb.VectorIndexSize
+		if binary.LittleEndian.Uint32(buf[idx:]) == 0 {
+			binary.LittleEndian.PutUint32(buf[idx:], ptr)
+		}
+		binary.LittleEndian.PutUint32(buf[idx+4:], ptr+xdb.SegmentIndexBlockSize)
+	}
+
+	binary.LittleEndian.PutUint16(buf, xdbStructure20)
+	binary.LittleEndian.PutUint16(buf[2:], uint16(xdb.VectorIndexPolicy))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(createdAt.Unix()))
+	binary.LittleEndian.PutUint32(buf[8:], startPtr)
+	binary.LittleEndian.PutUint32(buf[12:], uint32(len(buf))-xdb.SegmentIndexBlockSize)
+	return buf, nil
+}
+
+// split cuts segments at every /16 boundary
+func split(segments []segment) []segment {
+	var out []segment
+	for _, s := range segments {
+		start := s.start
+		for {
+			end := start | 0xFFFF
+			if end >= s.end {
+				out = append(out, segment{start: start, end: s.end, region: s.region, line: s.line})
+				break
+			}
+			out = append(out, segment{start: start, end: end, region: s.region, line: s.line})
+			start = end + 1
+		}
+	}
+	return out
+}
+
+// verify looks up the first and last address of every segment in content
+func verify(content []byte, segments []segment) error {
+	searcher, err := xdb.NewWithBuffer(content)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range segments {
+		for _, ip := range []uint32{s.start, s.end} {
+			region, err := searcher.Search(ip)
+			if err != nil {
+				return fmt.Errorf("%s: %s", ipString(ip), err)
+			}
+			if region != s.region {
+				return fmt.Errorf("%s: got `%s`, want `%s`", ipString(ip), region, s.region)
+			}
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes content next to path and renames it into place
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
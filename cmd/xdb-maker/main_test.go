@@ -0,0 +1,160 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lionsoul2014/ip2region/binding/golang/xdb"
+)
+
+const testSource = `# ip2region source subset
+1.1.1.0|1.1.1.255|澳大利亚|0|0|0|0
+8.8.8.0|8.8.8.255|美国|0|0|0|Level3
+36.0.0.0|36.255.255.255|中国|0|北京|北京市|电信
+223.5.5.0|223.5.5.255|中国|0|浙江省|杭州市|阿里云
+`
+
+func TestBuildLookups(t *testing.T) {
+	segments, err := readSegments(strings.NewReader(testSource), formatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := append([]segment(nil), segments...)
+
+	covered, gaps, err := checkSegments(segments, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gaps != 5 {
+		t.Errorf("got %d gaps", gaps)
+	}
+
+	content, err := build(covered, time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	searcher, err := xdb.NewWithBuffer(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := func(ip uint32) string {
+		for _, s := range input {
+			if s.start <= ip && ip <= s.end {
+				return s.region
+			}
+		}
+		return ""
+	}
+
+	ips := []uint32{0, 0xFFFFFFFF}
+	for _, s := range input {
+		ips = append(ips, s.start, s.end, s.start-1, s.end+1, s.start+(s.end-s.start)/2)
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		ips = append(ips, r.Uint32())
+	}
+	for _, ip := range ips {
+		region, err := searcher.Search(ip)
+		if err != nil {
+			t.Fatalf("%s: %s", ipString(ip), err)
+		}
+		if want := expected(ip); region != want {
+			t.Errorf("%s: got %q, want %q", ipString(ip), region, want)
+		}
+	}
+}
+
+func TestCheckSegments(t *testing.T) {
+	overlap := "1.0.0.0|1.0.0.255|a|0|0|0|0\n1.0.0.128|1.0.1.0|b|0|0|0|0\n"
+	segments, err := readSegments(strings.NewReader(overlap), formatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := checkSegments(segments, true); err == nil || !strings.Contains(err.Error(), "overlaps") {
+		t.Errorf("overlap not reported: %v", err)
+	}
+
+	segments, _ = readSegments(strings.NewReader(testSource), formatText)
+	if _, _, err := checkSegments(segments, false); err == nil || !strings.Contains(err.Error(), "not covered") {
+		t.Errorf("gaps not reported: %v", err)
+	}
+
+	full := "0.0.0.0|127.255.255.255|a|0|0|0|0\n128.0.0.0|255.255.255.255|b|0|0|0|0\n"
+	segments, _ = readSegments(strings.NewReader(full), formatText)
+	if _, gaps, err := checkSegments(segments, false); err != nil || gaps != 0 {
+		t.Errorf("full coverage rejected: %d gaps, %v", gaps, err)
+	}
+}
+
+func TestReadCSV(t *testing.T) {
+	source := "# office ranges\n10.1.0.0/16,中国,0,浙江省,杭州市,office\n10.2.0.0,10.2.0.255,中国,0,0,0,vpn\n"
+	segments, err := readSegments(strings.NewReader(source), formatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 {
+		t.Fatalf("got %d segments", len(segments))
+	}
+	if s := segments[0]; ipString(s.start) != "10.1.0.0" || ipString(s.end) != "10.1.255.255" || s.region != "中国|0|浙江省|杭州市|office" {
+		t.Errorf("invalid cidr segment: %+v", s)
+	}
+	if s := segments[1]; ipString(s.end) != "10.2.0.255" || s.region != "中国|0|0|0|vpn" {
+		t.Errorf("invalid range segment: %+v", s)
+	}
+
+	if _, err := readSegments(strings.NewReader("2001:db8::/32,日本\n"), formatCSV); err == nil {
+		t.Error("IPv6 accepted")
+	}
+}
+
+func TestRegionFields(t *testing.T) {
+	tests := map[string]struct {
+		source string
+		format string
+	}{
+		"text fewer": {"1.0.0.0|1.0.0.255|中国|0|0|0\n", formatText},
+		"text more":  {"1.0.0.0|1.0.0.255|中国|0|0|0|0|0\n", formatText},
+		"csv fewer":  {"1.0.0.0/24,中国,0,0,0\n", formatCSV},
+		"csv more":   {"1.0.0.0,1.0.0.255,中国,0,0,0,0,0\n", formatCSV},
+	}
+	for name, test := range tests {
+		_, err := readSegments(strings.NewReader(test.source), test.format)
+		if err == nil || !strings.Contains(err.Error(), "region fields") {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "ip.merge.txt")
+	dst := filepath.Join(dir, "ip2region.xdb")
+	if err := os.WriteFile(src, []byte(testSource), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := run(src, dst, formatText, false); err == nil {
+		t.Fatal("gaps accepted without -allow-gaps")
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Error("file written although the source was rejected")
+	}
+
+	if err := run(src, dst, formatText, true); err != nil {
+		t.Fatal(err)
+	}
+	content, err := xdb.LoadContentFromFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	searcher, _ := xdb.NewWithBuffer(content)
+	if region, _ := searcher.SearchByStr("223.5.5.5"); region != "中国|0|浙江省|杭州市|阿里云" {
+		t.Errorf("got %q", region)
+	}
+}
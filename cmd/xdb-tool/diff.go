@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// regionFields 国家|区域|省份|城市|ISP
+var regionFields = []string{"country", "region", "province", "city", "isp"}
+
+// change a range whose region differs between two files
+type change struct {
+	start uint32
+	end   uint32
+	old   string
+	new   string
+}
+
+// movement addresses a country or ISP lost to or gained from others
+type movement struct {
+	name   string
+	lost   uint64
+	gained uint64
+}
+
+// diffStats the summary of a diff
+type diffStats struct {
+	ranges    int
+	addresses uint64
+	// addresses whose field changed, in regionFields order
+	fields    []uint64
+	countries map[string]*movement
+	isps      map[string]*movement
+}
+
+// diff compares two sorted segment lists at range level, addresses missing
+// from one of them count as an empty region
+func diff(old, new []segment) []change {
+	points := []uint64{0, 1 << 32}
+	for _, segments := range [][]segment{old, new} {
+		for _, s := range segments {
+			points = append(points, uint64(s.start), uint64(s.end)+1)
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i] < points[j] })
+
+	var changes []change
+	i, j := 0, 0
+	for k := 0; k < len(points)-1; k++ {
+		lo, hi := points[k], points[k+1]-1
+		if hi < lo || lo > 0xFFFFFFFF {
+			continue
+		}
+
+		o, n := regionAt(old, &i, lo), regionAt(new, &j, lo)
+		if o == n {
+			continue
+		}
+		if c := len(changes) - 1; c >= 0 && uint64(changes[c].end)+1 == lo && changes[c].old == o && changes[c].new == n {
+			changes[c].end = uint32(hi)
+			continue
+		}
+		changes = append(changes, change{start: uint32(lo), end: uint32(hi), old: o, new: n})
+	}
+	return changes
+}
+
+// regionAt returns the region of ip, i walks forward through the sorted segments
+func regionAt(segments []segment, i *int, ip uint64) string {
+	for *i < len(segments) && uint64(segments[*i].end) < ip {
+		*i++
+	}
+	if *i < len(segments) && uint64(segments[*i].start) <= ip {
+		return segments[*i].region
+	}
+	return ""
+}
+
+// summarize counts the changed addresses per field, country and ISP
+func summarize(changes []change) diffStats {
+	stats := diffStats{
+		ranges:    len(changes),
+		fields:    make([]uint64, len(regionFields)),
+		countries: map[string]*movement{},
+		isps:      map[string]*movement{},
+	}
+
+	for _, c := range changes {
+		size := uint64(c.end) - uint64(c.start) + 1
+		stats.addresses += size
+
+		o, n := splitRegion(c.old), splitRegion(c.new)
+		for f := range regionFields {
+			if o[f] != n[f] {
+				stats.fields[f] += size
+			}
+		}
+		if o[0] != n[0] {
+			move(stats.countries, o[0], n[0], size)
+		}
+		if o[4] != n[4] {
+			move(stats.isps, o[4], n[4], size)
+		}
+	}
+	return stats
+}
+
+func move(m map[string]*movement, from, to string, size uint64) {
+	get := func(name string) *movement {
+		if m[name] == nil {
+			m[name] = &movement{name: name}
+		}
+		return m[name]
+	}
+	get(from).lost += size
+	get(to).gained += size
+}
+
+// splitRegion returns the fields of region, missing and 0 ones are empty
+func splitRegion(region string) []string {
+	fields := make([]string, len(regionFields))
+	if region != "" {
+		copy(fields, strings.Split(region, "|"))
+	}
+	for i, f := range fields {
+		if f == "0" {
+			fields[i] = ""
+		}
+	}
+	return fields
+}
+
+// writeChanges prints every change in a unified diff like format
+func writeChanges(w io.Writer, changes []change) error {
+	for _, c := range changes {
+		r := ipString(c.start) + "|" + ipString(c.end)
+		if _, err := fmt.Fprintf(w, "-%s|%s\n+%s|%s\n", r, c.old, r, c.new); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSummary prints the statistics, countries and ISPs with most changed addresses first
+func writeSummary(w io.Writer, stats diffStats) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "changed ranges:\t%d\n", stats.ranges)
+	fmt.Fprintf(tw, "changed addresses:\t%d\n", stats.addresses)
+	for f, name := range regionFields {
+		fmt.Fprintf(tw, "  %s:\t%d\n", name, stats.fields[f])
+	}
+
+	for _, table := range []struct {
+		title string
+		m     map[string]*movement
+	}{{"country", stats.countries}, {"isp", stats.isps}} {
+		if len(table.m) == 0 {
+			continue
+		}
+		fmt.Fprintf(tw, "\n%s\tlost\tgained\n", table.title)
+		for _, mv := range sortMovements(table.m) {
+			name := mv.name
+			if name == "" {
+				name = "(none)"
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%d\n", name, mv.lost, mv.gained)
+		}
+	}
+	return tw.Flush()
+}
+
+func sortMovements(m map[string]*movement) []*movement {
+	movements := make([]*movement, 0, len(m))
+	for _, mv := range m {
+		movements = append(movements, mv)
+	}
+	sort.Slice(movements, func(i, j int) bool {
+		a, b := movements[i].lost+movements[i].gained, movements[j].lost+movements[j].gained
+		if a != b {
+			return a > b
+		}
+		return movements[i].name < movements[j].name
+	})
+	return movements
+}
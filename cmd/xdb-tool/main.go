@@ -0,0 +1,166 @@
+// Command xdb-tool inspects ip2region xdb files.
+//
+// Usage:
+//
+//	xdb-tool dump [-raw] ip2region.xdb
+//	xdb-tool diff [-summary] old.xdb new.xdb
+//	xdb-tool verify ip2region.xdb...
+//
+// dump prints the ranges as ip2region source data, adjacent blocks with the same
+// region merged unless -raw is given. diff prints the ranges whose region changed
+// followed by the number of affected addresses per field, country and ISP.
+// verify checks header, vector index and segment ordering and exits with status 1
+// when a file has problems.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// maxProblems printed per file by verify
+const maxProblems = 20
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("xdb-tool: ")
+
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "dump":
+		err = dumpCmd(args)
+	case "diff":
+		err = diffCmd(args)
+	case "verify":
+		err = verifyCmd(args)
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: xdb-tool dump [-raw] file | diff [-summary] old new | verify file...")
+	os.Exit(2)
+}
+
+func dumpCmd(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	raw := fs.Bool("raw", false, "print every segment index block")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+
+	f, err := openXdb(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	segments, err := f.segments()
+	if err != nil {
+		return err
+	}
+	if !*raw {
+		segments = merge(segments)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	if err := dump(w, segments); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// dump writes startIP|endIP|region lines
+func dump(w io.Writer, segments []segment) error {
+	for _, s := range segments {
+		if _, err := fmt.Fprintf(w, "%s|%s|%s\n", ipString(s.start), ipString(s.end), s.region); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func diffCmd(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	summaryOnly := fs.Bool("summary", false, "print the statistics only")
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 {
+		usage()
+	}
+
+	var files [2][]segment
+	for i, path := range fs.Args() {
+		f, err := openXdb(path)
+		if err != nil {
+			return err
+		}
+		segments, err := f.segments()
+		if err != nil {
+			return err
+		}
+		sort.SliceStable(segments, func(i, j int) bool { return segments[i].start < segments[j].start })
+		files[i] = merge(segments)
+	}
+
+	changes := diff(files[0], files[1])
+	w := bufio.NewWriter(os.Stdout)
+	if !*summaryOnly {
+		if err := writeChanges(w, changes); err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+	}
+	if err := writeSummary(w, summarize(changes)); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func verifyCmd(args []string) error {
+	if len(args) == 0 {
+		usage()
+	}
+
+	failed := 0
+	for _, path := range args {
+		f, err := openXdb(path)
+		if err != nil {
+			log.Print(err)
+			failed++
+			continue
+		}
+
+		problems := verify(f)
+		if len(problems) == 0 {
+			createdAt := time.Unix(int64(f.header.CreatedAt), 0).UTC().Format(time.RFC3339)
+			fmt.Printf("%s: ok, %d blocks, created at %s\n", path, f.blockCount(), createdAt)
+			continue
+		}
+
+		failed++
+		for i, p := range problems {
+			if i == maxProblems {
+				log.Printf("%s: and %d more problems", path, len(problems)-maxProblems)
+				break
+			}
+			log.Printf("%s: %s", path, p)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed verification", failed, len(args))
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lionsoul2014/ip2region/binding/golang/xdb"
+)
+
+// testSegments covers the IPv4 space, unlisted addresses have an empty region
+var testSegments = []segment{
+	{ip("1.1.1.0"), ip("1.1.1.255"), "澳大利亚|0|0|0|0"},
+	{ip("8.8.8.0"), ip("8.8.8.255"), "美国|0|0|0|Level3"},
+	{ip("36.0.0.0"), ip("36.255.255.255"), "中国|0|北京|北京市|电信"},
+	{ip("223.5.5.0"), ip("223.5.5.255"), "中国|0|浙江省|杭州市|阿里云"},
+}
+
+func ip(s string) uint32 {
+	return binary.BigEndian.Uint32(netip.MustParseAddr(s).AsSlice())
+}
+
+// buildTestXdb writes a v2 xdb file the way xdb-maker does
+func buildTestXdb(t *testing.T, segments []segment) string {
+	t.Helper()
+
+	var full []segment
+	next := uint64(0)
+	for _, s := range segments {
+		if uint64(s.start) > next {
+			full = append(full, segment{start: uint32(next), end: s.start - 1})
+		}
+		full = append(full, s)
+		next = uint64(s.end) + 1
+	}
+	if next <= 0xFFFFFFFF {
+		full = append(full, segment{start: uint32(next), end: 0xFFFFFFFF})
+	}
+
+	buf := make([]byte, xdb.HeaderInfoLength+vectorIndexLength)
+	regionPtr := map[string]uint32{}
+	for _, s := range full {
+		if _, ok := regionPtr[s.region]; !ok && s.region != "" {
+			regionPtr[s.region] = uint32(len(buf))
+			buf = append(buf, s.region...)
+		}
+	}
+
+	startPtr := uint32(len(buf))
+	block := make([]byte, xdb.SegmentIndexBlockSize)
+	for _, s := range full {
+		for start := s.start; ; start = start | 0xFFFF + 1 {
+			end := start | 0xFFFF
+			if end > s.end {
+				end = s.end
+			}
+			ptr := uint32(len(buf))
+			binary.LittleEndian.PutUint32(block, start)
+			binary.LittleEndian.PutUint32(block[4:], end)
+			binary.LittleEndian.PutUint16(block[8:], uint16(len(s.region)))
+			binary.LittleEndian.PutUint32(block[10:], regionPtr[s.region])
+			buf = append(buf, block...)
+
+			idx := xdb.HeaderInfoLength + int(start>>16)*xdb.VectorIndexSize
+			if binary.LittleEndian.Uint32(buf[idx:]) == 0 {
+				binary.LittleEndian.PutUint32(buf[idx:], ptr)
+			}
+			binary.LittleEndian.PutUint32(buf[idx+4:], ptr+xdb.SegmentIndexBlockSize)
+			if end == s.end {
+				break
+			}
+		}
+	}
+
+	binary.LittleEndian.PutUint16(buf, xdbStructure20)
+	binary.LittleEndian.PutUint16(buf[2:], uint16(xdb.VectorIndexPolicy))
+	binary.LittleEndian.PutUint32(buf[4:], 1700000000)
+	binary.LittleEndian.PutUint32(buf[8:], startPtr)
+	binary.LittleEndian.PutUint32(buf[12:], uint32(len(buf))-xdb.SegmentIndexBlockSize)
+
+	path := filepath.Join(t.TempDir(), "test.xdb")
+	if err := os.WriteFile(path, buf, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVerify(t *testing.T) {
+	path := buildTestXdb(t, testSegments)
+	f, err := openXdb(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := verify(f); len(problems) != 0 {
+		t.Fatalf("valid file: %v", problems)
+	}
+
+	tests := map[string]struct {
+		corrupt func(f *xdbFile)
+		problem string
+	}{
+		"order": {func(f *xdbFile) {
+			// swap the first two blocks
+			a := f.content[f.header.StartIndexPtr:]
+			tmp := append([]byte(nil), a[:xdb.SegmentIndexBlockSize]...)
+			copy(a, a[xdb.SegmentIndexBlockSize:2*xdb.SegmentIndexBlockSize])
+			copy(a[xdb.SegmentIndexBlockSize:], tmp)
+		}, "out of order"},
+		"vector": {func(f *xdbFile) {
+			copy(f.content[xdb.HeaderInfoLength+ip("8.8.0.0")>>16*xdb.VectorIndexSize:], make([]byte, 8))
+		}, "vector index 8.8: empty"},
+		"region": {func(f *xdbFile) {
+			binary.LittleEndian.PutUint32(f.content[f.header.EndIndexPtr+10:], uint32(len(f.content)))
+			binary.LittleEndian.PutUint16(f.content[f.header.EndIndexPtr+8:], 4)
+		}, "outside the file"},
+	}
+	for name, test := range tests {
+		f, _ := openXdb(path)
+		test.corrupt(f)
+		problems := strings.Join(verify(f), "\n")
+		if !strings.Contains(problems, test.problem) {
+			t.Errorf("%s: got %q", name, problems)
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	f, err := openXdb(buildTestXdb(t, testSegments))
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments, err := f.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := dump(&buf, merge(segments)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "\n36.0.0.0|36.255.255.255|中国|0|北京|北京市|电信\n") {
+		t.Errorf("split blocks not merged:\n%s", buf.String())
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 9 {
+		t.Errorf("got %d lines", lines)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	newSegments := append([]segment(nil), testSegments...)
+	// 36.1.0.0/16 moves to another province and ISP
+	newSegments[2] = segment{ip("36.0.0.0"), ip("36.0.255.255"), "中国|0|北京|北京市|电信"}
+	newSegments = append(newSegments[:3], append([]segment{
+		{ip("36.1.0.0"), ip("36.1.255.255"), "中国|0|上海|上海市|联通"},
+		{ip("36.2.0.0"), ip("36.255.255.255"), "中国|0|北京|北京市|电信"},
+	}, newSegments[3:]...)...)
+	// 8.8.8.0/24 disappears
+	newSegments = append(newSegments[:1], newSegments[2:]...)
+
+	load := func(path string) []segment {
+		f, err := openXdb(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments, err := f.segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return merge(segments)
+	}
+	changes := diff(load(buildTestXdb(t, testSegments)), load(buildTestXdb(t, newSegments)))
+	if len(changes) != 2 {
+		t.Fatalf("got %d changes: %+v", len(changes), changes)
+	}
+	if c := changes[1]; c.start != ip("36.1.0.0") || c.end != ip("36.1.255.255") || c.new != "中国|0|上海|上海市|联通" {
+		t.Errorf("invalid change: %+v", c)
+	}
+
+	stats := summarize(changes)
+	if stats.addresses != 256+65536 || stats.fields[0] != 256 || stats.fields[1] != 0 || stats.fields[2] != 65536 || stats.fields[4] != 256+65536 {
+		t.Errorf("invalid stats: %+v", stats)
+	}
+	if mv := stats.countries["美国"]; mv == nil || mv.lost != 256 {
+		t.Errorf("country loss not counted: %+v", mv)
+	}
+	if mv := stats.isps["联通"]; mv == nil || mv.gained != 65536 {
+		t.Errorf("isp gain not counted: %+v", mv)
+	}
+
+	var buf bytes.Buffer
+	if err := writeSummary(&buf, stats); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "changed addresses:") {
+		t.Errorf("invalid summary:\n%s", buf.String())
+	}
+}
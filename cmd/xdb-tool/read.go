@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+
+	"github.com/lionsoul2014/ip2region/binding/golang/xdb"
+)
+
+// xdb structure versions holding IPv4 segments in the v2 block layout
+const (
+	xdbStructure20 = 2
+	xdbStructure30 = 3
+)
+
+// vectorIndexLength the size of the vector index following the header
+const vectorIndexLength = xdb.VectorIndexRows * xdb.VectorIndexCols * xdb.VectorIndexSize
+
+// segment one block of the segment index, or a merged range of blocks
+type segment struct {
+	start  uint32
+	end    uint32
+	region string
+}
+
+// xdbFile an xdb file held in memory
+type xdbFile struct {
+	content []byte
+	header  *xdb.Header
+}
+
+// openXdb loads path and checks the header just enough to walk the segment index
+func openXdb(path string) (*xdbFile, error) {
+	content, err := xdb.LoadContentFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(content) < xdb.HeaderInfoLength+vectorIndexLength {
+		return nil, fmt.Errorf("%s: file too small: %d bytes", path, len(content))
+	}
+
+	header, err := xdb.NewHeader(content[:xdb.HeaderInfoLength])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	switch header.Version {
+	case xdbStructure20:
+	case xdbStructure30:
+		if ipVersion := binary.LittleEndian.Uint16(content[16:]); ipVersion != 4 {
+			return nil, fmt.Errorf("%s: IPv%d files are not supported", path, ipVersion)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unsupported xdb structure version %d", path, header.Version)
+	}
+
+	if int(header.StartIndexPtr) < xdb.HeaderInfoLength+vectorIndexLength || header.StartIndexPtr > header.EndIndexPtr ||
+		int(header.EndIndexPtr)+xdb.SegmentIndexBlockSize > len(content) {
+		return nil, fmt.Errorf("%s: invalid index pointers %d-%d", path, header.StartIndexPtr, header.EndIndexPtr)
+	}
+	return &xdbFile{content: content, header: header}, nil
+}
+
+// blockCount the number of segment index blocks
+func (f *xdbFile) blockCount() int {
+	return int(f.header.EndIndexPtr-f.header.StartIndexPtr)/xdb.SegmentIndexBlockSize + 1
+}
+
+// block decodes the segment index block at ptr
+func (f *xdbFile) block(ptr uint32) (segment, error) {
+	b := f.content[ptr : ptr+xdb.SegmentIndexBlockSize]
+	s := segment{start: binary.LittleEndian.Uint32(b), end: binary.LittleEndian.Uint32(b[4:])}
+
+	dataLen := uint32(binary.LittleEndian.Uint16(b[8:]))
+	dataPtr := binary.LittleEndian.Uint32(b[10:])
+	if dataLen > 0 {
+		if uint64(dataPtr)+uint64(dataLen) > uint64(len(f.content)) {
+			return s, fmt.Errorf("block at %d: region %d+%d outside the file", ptr, dataPtr, dataLen)
+		}
+		s.region = string(f.content[dataPtr : dataPtr+dataLen])
+	}
+	return s, nil
+}
+
+// segments returns every block of the segment index in file order
+func (f *xdbFile) segments() ([]segment, error) {
+	segments := make([]segment, 0, f.blockCount())
+	for ptr := f.header.StartIndexPtr; ptr <= f.header.EndIndexPtr; ptr += xdb.SegmentIndexBlockSize {
+		s, err := f.block(ptr)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, s)
+	}
+	return segments, nil
+}
+
+// merge joins adjacent segments with the same region, undoing the /16 split of the maker
+func merge(segments []segment) []segment {
+	var out []segment
+	for _, s := range segments {
+		if n := len(out); n > 0 && out[n-1].region == s.region && uint64(out[n-1].end)+1 == uint64(s.start) {
+			out[n-1].end = s.end
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// size the number of addresses in the segment
+func (s segment) size() uint64 {
+	return uint64(s.end) - uint64(s.start) + 1
+}
+
+func ipString(ip uint32) string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], ip)
+	return netip.AddrFrom4(b).String()
+}
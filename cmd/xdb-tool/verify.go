@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/lionsoul2014/ip2region/binding/golang/xdb"
+)
+
+// verify checks header, vector index and segment ordering of f and looks up
+// every segment through xdb.Searcher. Returns every problem found.
+func verify(f *xdbFile) []string {
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	h := f.header
+	if h.IndexPolicy != xdb.VectorIndexPolicy && h.IndexPolicy != xdb.BTreeIndexPolicy {
+		report("header: unknown index policy %d", h.IndexPolicy)
+	}
+	if (h.EndIndexPtr-h.StartIndexPtr)%xdb.SegmentIndexBlockSize != 0 {
+		report("header: index pointers %d-%d are not aligned to %d byte blocks",
+			h.StartIndexPtr, h.EndIndexPtr, xdb.SegmentIndexBlockSize)
+		return problems
+	}
+
+	segments, err := f.segments()
+	if err != nil {
+		report("segment index: %s", err)
+		return problems
+	}
+
+	// ordering, the blocks must cover the IPv4 space without gaps or overlaps
+	next := uint64(0)
+	for i, s := range segments {
+		switch {
+		case s.start > s.end:
+			report("block %d: start %s after end %s", i, ipString(s.start), ipString(s.end))
+		case uint64(s.start) < next:
+			report("block %d: %s-%s overlaps or is out of order", i, ipString(s.start), ipString(s.end))
+		case uint64(s.start) > next:
+			report("block %d: gap %s-%s before it", i, ipString(uint32(next)), ipString(s.start-1))
+		}
+		if s.start>>16 != s.end>>16 {
+			report("block %d: %s-%s crosses a /16 boundary", i, ipString(s.start), ipString(s.end))
+		}
+		if uint64(s.end)+1 > next {
+			next = uint64(s.end) + 1
+		}
+	}
+	if next <= 0xFFFFFFFF {
+		report("segment index: %s-255.255.255.255 not covered", ipString(uint32(next)))
+	}
+
+	vectorProblems := len(problems)
+	for cell := uint32(0); cell < xdb.VectorIndexRows*xdb.VectorIndexCols; cell++ {
+		verifyCell(f, cell, report)
+	}
+
+	// lookups read through the vector index and would fail on a broken one
+	if len(problems) > vectorProblems {
+		return problems
+	}
+	searcher, err := xdb.NewWithBuffer(f.content)
+	if err != nil {
+		report("searcher: %s", err)
+		return problems
+	}
+	for _, s := range segments {
+		for _, ip := range []uint32{s.start, s.end} {
+			region, err := searcher.Search(ip)
+			if err != nil {
+				report("lookup %s: %s", ipString(ip), err)
+			} else if region != s.region {
+				report("lookup %s: got `%s`, index says `%s`", ipString(ip), region, s.region)
+			}
+		}
+	}
+	return problems
+}
+
+// verifyCell checks that the vector index cell of the /16 network cell points at
+// blocks of that network covering it completely
+func verifyCell(f *xdbFile, cell uint32, report func(string, ...interface{})) {
+	h := f.header
+	name := fmt.Sprintf("vector index %d.%d", cell>>8, cell&0xFF)
+
+	idx := xdb.HeaderInfoLength + cell*xdb.VectorIndexSize
+	sPtr := binary.LittleEndian.Uint32(f.content[idx:])
+	ePtr := binary.LittleEndian.Uint32(f.content[idx+4:])
+	if sPtr == 0 && ePtr == 0 {
+		report("%s: empty", name)
+		return
+	}
+	if sPtr < h.StartIndexPtr || ePtr <= sPtr || ePtr > h.EndIndexPtr+xdb.SegmentIndexBlockSize ||
+		(ePtr-sPtr)%xdb.SegmentIndexBlockSize != 0 || (sPtr-h.StartIndexPtr)%xdb.SegmentIndexBlockSize != 0 {
+		report("%s: invalid pointers %d-%d", name, sPtr, ePtr)
+		return
+	}
+
+	first, _ := f.block(sPtr)
+	last, _ := f.block(ePtr - xdb.SegmentIndexBlockSize)
+	if first.start != cell<<16 || last.end != cell<<16|0xFFFF {
+		report("%s: blocks cover %s-%s", name, ipString(first.start), ipString(last.end))
+	}
+}
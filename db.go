@@ -0,0 +1,416 @@
+package traefik_ip2region
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// registry shares loaded databases between middleware instances
+var registry = &dbRegistry{entries: map[string]*dbEntry{}}
+
+// dbRegistry keeps one searcher per database file.
+// Instances configured with the same file share a single in-memory buffer,
+// instances configured with different files stay separate.
+type dbRegistry struct {
+	mu      sync.Mutex
+	entries map[string]*dbEntry
+}
+
+// dbEntry a loaded database shared by reference count
+type dbEntry struct {
+	key         string
+	path        string
+	cachePolicy string
+	poolSize    int
+	provider    string
+	mmdb        Mmdb
+	refs        int
+	stopCh      chan struct{}
+	downloadCh  chan struct{}
+	staleCh     chan struct{}
+	// the download settings, empty when the file is not downloaded
+	downloadKey string
+	// set for a database from the configuration, path is then only its name
+	inline *inlineSource
+
+	mu       sync.RWMutex
+	searcher ipSearcher
+	// set once the last instance released the entry, nothing is loaded anymore
+	closed    bool
+	meta      *dbMeta
+	ipVersion int
+	version   int
+	loadedAt  time.Time
+	modTime   time.Time
+	size      int64
+	// the shortest maxAge of the instances and the version last reported stale
+	maxAge       time.Duration
+	staleVersion int
+	// distinct values of the database at vocabVersion
+	vocab        *vocabulary
+	vocabVersion int
+}
+
+// dbInfo describes the database currently in use
+type dbInfo struct {
+	Path     string
+	Version  int
+	LoadedAt time.Time
+	// from the database file, nil while not loaded
+	Meta *dbMeta
+}
+
+// defaultRetryInterval how often a database that failed to load is retried
+// when no reloadInterval is configured
+const defaultRetryInterval = 30 * time.Second
+
+// staleCheckInterval how often a loaded database is checked against maxAge
+const staleCheckInterval = time.Hour
+
+// dbOptions how a database is loaded and watched
+type dbOptions struct {
+	// 4 or 6, the address family the file must contain, 0 for any
+	ipVersion      int
+	cachePolicy    string
+	poolSize       int
+	reloadInterval time.Duration
+	// allowMissing keeps the entry when the first load fails and retries in the background
+	allowMissing bool
+	// xdb, mmdb or empty to detect the format
+	provider string
+	mmdb     Mmdb
+	// optional, keeps the file up to date from a URL
+	download *downloader
+	// optional, the database comes from the configuration instead of dbPath
+	inline *inlineSource
+	// optional, warns when the database was built longer ago
+	maxAge time.Duration
+}
+
+// acquire returns the database for dbPath, loading it on first use.
+// Instances share a database when path, address family, provider, cache policy and download settings match.
+// A positive reloadInterval starts watching the file for changes.
+func (r *dbRegistry) acquire(dbPath string, opts dbOptions) (*dbEntry, error) {
+	name := dbKey(dbPath)
+	if opts.inline != nil {
+		name = dbPath
+	}
+	downloadKey, fetched := "", false
+	if opts.download != nil {
+		downloadKey = opts.download.key()
+		// the first download happens before the first load when there is no file yet,
+		// outside the lock so other instances do not wait for the server
+		if _, err := os.Stat(dbPath); err != nil {
+			fetched = true
+			if _, err := opts.download.fetch(func(path string) error { return checkDatabase(path, opts) }); err != nil {
+				log.Printf("ip2region: %s", err)
+			}
+		}
+	}
+	key := fmt.Sprintf("%s|v%d|%s|%s|%s|%t|%s", name, opts.ipVersion, opts.cachePolicy,
+		opts.provider, opts.mmdb.Language, opts.mmdb.CountryISOCode, downloadKey)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.entries[key]
+	if !ok {
+		if downloadKey != "" {
+			// two downloaders must not overwrite each other's file
+			for _, other := range r.entries {
+				if other.downloadKey != "" && other.downloadKey != downloadKey && dbKey(other.path) == name {
+					return nil, fmt.Errorf("`%s` is already downloaded with different download settings", dbPath)
+				}
+			}
+		}
+
+		e = &dbEntry{key: key, path: dbPath, ipVersion: opts.ipVersion, cachePolicy: opts.cachePolicy, poolSize: opts.poolSize,
+			provider: opts.provider, mmdb: opts.mmdb, inline: opts.inline, maxAge: opts.maxAge, downloadKey: downloadKey}
+		if err := e.load(); err != nil {
+			if !opts.allowMissing {
+				return nil, err
+			}
+			log.Printf("ip2region: starting without `%s`, retrying in the background: %s", dbPath, err)
+		}
+		if opts.download != nil {
+			e.downloadCh = make(chan struct{})
+			go e.downloadLoop(opts.download, e.downloadCh, !fetched)
+		}
+		r.entries[key] = e
+	}
+
+	e.refs++
+	if opts.maxAge > 0 {
+		e.mu.Lock()
+		shorter := e.maxAge == 0 || opts.maxAge < e.maxAge
+		if shorter {
+			e.maxAge = opts.maxAge
+		}
+		e.mu.Unlock()
+		if shorter {
+			e.checkStale()
+		}
+		// a database may go stale while it stays loaded
+		if e.staleCh == nil {
+			e.staleCh = make(chan struct{})
+			go e.watchStale(e.staleCh)
+		}
+	}
+
+	interval := opts.reloadInterval
+	if interval <= 0 && !e.loaded() {
+		interval = defaultRetryInterval
+	}
+	// an inline database only changes with the configuration
+	if interval > 0 && e.stopCh == nil && e.inline == nil {
+		e.stopCh = make(chan struct{})
+		go watchFile(e.path, interval, e.stopCh, e.stamp, e.load)
+	}
+	return e, nil
+}
+
+// release drops one reference, the database is unloaded with the last one.
+func (r *dbRegistry) release(e *dbEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e.refs--
+	if e.refs > 0 {
+		return
+	}
+
+	if r.entries[e.key] == e {
+		delete(r.entries, e.key)
+	}
+	if e.stopCh != nil {
+		close(e.stopCh)
+		e.stopCh = nil
+	}
+	if e.downloadCh != nil {
+		close(e.downloadCh)
+		e.downloadCh = nil
+	}
+	if e.staleCh != nil {
+		close(e.staleCh)
+		e.staleCh = nil
+	}
+
+	e.mu.Lock()
+	if e.searcher != nil {
+		e.searcher.Close()
+		e.searcher = nil
+	}
+	e.closed = true
+	e.mu.Unlock()
+}
+
+// supports reports whether the loaded database holds addresses of ipVersion
+func (e *dbEntry) supports(ipVersion int) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.meta != nil && e.meta.supports(ipVersion)
+}
+
+// format returns the format of the loaded database, xdb until it is loaded
+func (e *dbEntry) format() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.meta == nil {
+		return dbFormatXdb
+	}
+	return e.meta.Format
+}
+
+// search looks up ip in the current database, also returns the io count
+func (e *dbEntry) search(ip string) (string, int, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.searcher == nil {
+		return "", 0, fmt.Errorf("database `%s` is not loaded", e.path)
+	}
+	return e.searcher.search(ip)
+}
+
+// loaded reports whether a database is available, false while degraded
+func (e *dbEntry) loaded() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.searcher != nil
+}
+
+// info returns the version and load time of the current database
+func (e *dbEntry) info() dbInfo {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return dbInfo{Path: e.path, Version: e.version, LoadedAt: e.loadedAt, Meta: e.meta}
+}
+
+// load reads and validates the file, then swaps it in atomically.
+// On failure the current searcher stays in use.
+func (e *dbEntry) load() error {
+	var (
+		searcher ipSearcher
+		meta     *dbMeta
+		modTime  time.Time
+		size     int64
+	)
+	if e.inline != nil {
+		var err error
+		if searcher, meta, err = e.inline.load(); err != nil {
+			return err
+		}
+	} else {
+		fi, err := os.Stat(e.path)
+		if err != nil {
+			return fmt.Errorf("failed to stat `%s`: %s", e.path, err)
+		}
+		modTime, size = fi.ModTime(), fi.Size()
+
+		if searcher, meta, err = openDatabase(e.path, e.options()); err != nil {
+			return err
+		}
+	}
+
+	if e.ipVersion != 0 && !meta.supports(e.ipVersion) {
+		searcher.Close()
+		return fmt.Errorf("`%s` is not an IPv%d database", e.path, e.ipVersion)
+	}
+
+	e.mu.Lock()
+	if e.closed {
+		// released while loading
+		e.mu.Unlock()
+		searcher.Close()
+		return fmt.Errorf("database `%s` is released", e.path)
+	}
+	old := e.searcher
+	e.searcher = searcher
+	e.meta = meta
+	e.version++
+	e.loadedAt = time.Now()
+	e.modTime = modTime
+	e.size = size
+	e.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	log.Printf("ip2region: loaded `%s`: %s", e.path, meta)
+	e.checkStale()
+	return nil
+}
+
+// checkStale logs a warning the first time a database version is older than maxAge
+func (e *dbEntry) checkStale() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.staleVersion == e.version || !isStale(e.meta, e.maxAge) {
+		return
+	}
+	e.staleVersion = e.version
+	log.Printf("ip2region: `%s` was created at %s and is older than %s",
+		e.path, e.meta.CreatedAt.Format(time.RFC3339), e.maxAge)
+}
+
+// watchStale repeats checkStale until stopCh is closed
+func (e *dbEntry) watchStale(stopCh chan struct{}) {
+	ticker := time.NewTicker(staleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			e.checkStale()
+		}
+	}
+}
+
+// options returns how the files of this entry are loaded
+func (e *dbEntry) options() dbOptions {
+	return dbOptions{
+		ipVersion:   e.ipVersion,
+		cachePolicy: e.cachePolicy,
+		poolSize:    e.poolSize,
+		provider:    e.provider,
+		mmdb:        e.mmdb,
+	}
+}
+
+// openDatabase loads path like loadDatabase and checks it holds the address family of opts
+func openDatabase(path string, opts dbOptions) (ipSearcher, *dbMeta, error) {
+	searcher, meta, err := loadDatabase(path, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.ipVersion != 0 && !meta.supports(opts.ipVersion) {
+		searcher.Close()
+		return nil, nil, fmt.Errorf("`%s` is not an IPv%d database", path, opts.ipVersion)
+	}
+	return searcher, meta, nil
+}
+
+// checkDatabase reports whether an entry with opts can load path
+func checkDatabase(path string, opts dbOptions) error {
+	searcher, _, err := openDatabase(path, opts)
+	if err != nil {
+		return err
+	}
+	searcher.Close()
+	return nil
+}
+
+// stamp returns the mtime and size of the loaded file
+func (e *dbEntry) stamp() (time.Time, int64) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.modTime, e.size
+}
+
+// watchFile polls path and calls reload when its mtime or size differs from the
+// loaded one reported by stamp, until stopCh is closed
+func watchFile(path string, interval time.Duration, stopCh chan struct{},
+	stamp func() (time.Time, int64), reload func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			fi, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if modTime, size := stamp(); fi.ModTime().Equal(modTime) && fi.Size() == size {
+				continue
+			}
+			if err := reload(); err != nil {
+				log.Printf("ip2region: reload of `%s` failed, keeping the loaded version: %s", path, err)
+			}
+		}
+	}
+}
+
+// dbKey normalizes dbPath so different spellings of the same file share an entry
+func dbKey(dbPath string) string {
+	abs, err := filepath.Abs(dbPath)
+	if err != nil {
+		return filepath.Clean(dbPath)
+	}
+	return abs
+}
@@ -0,0 +1,191 @@
+package traefik_ip2region
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRegistrySeparateFiles(t *testing.T) {
+	cnPath := writeTestXdb(t, []testRange{{"1.1.1.0", "1.1.1.255", "中国|0|0|0|0"}})
+	globalPath := writeTestXdb(t, testRanges)
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	cfg := CreateConfig()
+	cfg.DBPath = cnPath
+	cn, err := New(ctx, next, cfg, "cn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.(*TraefikIp2Region).Close()
+
+	cfg = CreateConfig()
+	cfg.DBPath = globalPath
+	global, err := New(ctx, next, cfg, "global")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer global.(*TraefikIp2Region).Close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "1.1.1.1:9999"
+	cn.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, "X-Ip2region-Country", "中国")
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "1.1.1.1:9999"
+	global.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, "X-Ip2region-Country", "澳大利亚")
+}
+
+func TestRegistrySharedFile(t *testing.T) {
+	path := writeTestXdb(t, testRanges)
+
+	a, err := registry.acquire(path, dbOptions{ipVersion: ipv4VersionNo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := registry.acquire(path, dbOptions{ipVersion: ipv4VersionNo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Fatal("instances with the same dbPath should share the database")
+	}
+
+	registry.release(a)
+	if _, ok := registry.entries[a.key]; !ok {
+		t.Fatal("database released while still referenced")
+	}
+
+	registry.release(b)
+	if _, ok := registry.entries[a.key]; ok {
+		t.Fatal("database not released after the last reference")
+	}
+	if _, _, err := a.search("1.1.1.1"); err == nil {
+		t.Error("released database searched")
+	}
+	if err := a.load(); err == nil || a.loaded() {
+		t.Error("released database loaded again")
+	}
+}
+
+func TestHotReload(t *testing.T) {
+	path := writeTestXdb(t, testRanges)
+
+	e, err := registry.acquire(path, dbOptions{ipVersion: ipv4VersionNo, reloadInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(e)
+
+	if v := e.info().Version; v != 1 {
+		t.Fatalf("invalid version: %d", v)
+	}
+
+	// a broken file must not replace the current database
+	future := time.Now().Add(time.Hour)
+	if err := os.WriteFile(path, []byte("broken"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if v := e.info().Version; v != 1 {
+		t.Fatalf("broken file was loaded, version: %d", v)
+	}
+
+	buff := buildTestXdb(t, []testRange{{"1.1.1.0", "1.1.1.255", "新西兰|0|0|0|0"}})
+	if err := os.WriteFile(path, buff, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	future = future.Add(time.Hour)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for e.info().Version < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("database was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	region, _, err := e.search("1.1.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if region != "新西兰|0|0|0|0" {
+		t.Errorf("invalid region after reload: %s", region)
+	}
+}
+
+func TestDegradedStart(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	for onDBError, status := range map[string]int{onDBErrorFailOpen: http.StatusOK, onDBErrorFailClosed: http.StatusServiceUnavailable} {
+		path := filepath.Join(t.TempDir(), "missing.xdb")
+
+		cfg := CreateConfig()
+		cfg.DBPath = path
+		cfg.OnDBError = onDBError
+		cfg.ReloadInterval = "10ms"
+		cfg.Headers.Degraded = "X-Ip2region-Degraded"
+		cfg.Whitelist.Enabled = true
+		cfg.Whitelist.Country = []string{"澳大利亚"}
+
+		handler, err := New(context.Background(), next, cfg, "demo-plugin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		plugin := handler.(*TraefikIp2Region)
+		if !plugin.Degraded() {
+			t.Fatalf("%s: expected a degraded start", onDBError)
+		}
+
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = "1.1.1.1:9999"
+		handler.ServeHTTP(recorder, req)
+		if recorder.Result().StatusCode != status {
+			t.Errorf("%s: invalid status code: %d", onDBError, recorder.Result().StatusCode)
+		}
+		assertHeader(t, req, "X-Ip2region-Degraded", "true")
+
+		// the database shows up later
+		if err := os.WriteFile(path, buildTestXdb(t, testRanges), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for plugin.Degraded() {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: database was not loaded", onDBError)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		recorder = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = "1.1.1.1:9999"
+		handler.ServeHTTP(recorder, req)
+		if recorder.Result().StatusCode != http.StatusOK {
+			t.Errorf("%s: invalid status code after load: %d", onDBError, recorder.Result().StatusCode)
+		}
+		assertHeader(t, req, "X-Ip2region-Country", "澳大利亚")
+		plugin.Close()
+	}
+
+	cfg := CreateConfig()
+	cfg.DBPath = filepath.Join(t.TempDir(), "missing.xdb")
+	if _, err := New(context.Background(), next, cfg, "demo-plugin"); err == nil {
+		t.Fatal("expected an error without onDbError")
+	}
+}
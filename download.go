@@ -0,0 +1,286 @@
+package traefik_ip2region
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultDownloadInterval how often the database URL is checked
+const defaultDownloadInterval = 24 * time.Hour
+
+// maxDownloadSize guards against endless responses
+const maxDownloadSize = 1 << 30
+
+// Download part of the configuration
+type Download struct {
+	// URL of the xdb or mmdb file, empty disables downloading
+	URL string `yaml:"url,omitempty"`
+	// Interval between checks, 24h by default
+	Interval string `yaml:"interval,omitempty"`
+	// SHA256 expected checksum of the file, hex encoded
+	SHA256 string `yaml:"sha256,omitempty"`
+	// SHA256URL detached checksum file in sha256sum format, fetched with every new file
+	SHA256URL string `yaml:"sha256Url,omitempty"`
+	// CacheDir where the file is written, the directory of dbPath by default
+	CacheDir string `yaml:"cacheDir,omitempty"`
+}
+
+// downloader fetches the database on a schedule and writes it atomically to target
+type downloader struct {
+	url       string
+	sha256    string
+	sha256URL string
+	target    string
+	interval  time.Duration
+	client    *http.Client
+
+	// conditional request state of the last good download
+	etag         string
+	lastModified string
+}
+
+// newDownloader returns nil when downloading is disabled
+func newDownloader(cfg Download, dbPath string) (*downloader, error) {
+	if cfg.URL == "" {
+		return nil, nil
+	}
+
+	interval := defaultDownloadInterval
+	if cfg.Interval != "" {
+		d, err := time.ParseDuration(cfg.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid download interval `%s`: %s", cfg.Interval, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid download interval `%s`", cfg.Interval)
+		}
+		interval = d
+	}
+
+	target := dbPath
+	if cfg.CacheDir != "" {
+		target = filepath.Join(cfg.CacheDir, filepath.Base(dbPath))
+	}
+
+	return &downloader{
+		url:       cfg.URL,
+		sha256:    strings.ToLower(strings.TrimSpace(cfg.SHA256)),
+		sha256URL: cfg.SHA256URL,
+		target:    target,
+		interval:  interval,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// key identifies the download settings, instances share a database only when they match
+func (d *downloader) key() string {
+	return fmt.Sprintf("%s|%s|%s|%s", d.url, d.sha256, d.sha256URL, d.interval)
+}
+
+// fetch downloads the file when it changed on the server.
+// It returns false when the server answered 304 Not Modified or sent the file already on disk.
+// accept, when set, is called with a staging copy and must be able to load it.
+// On any failure target is left untouched.
+func (d *downloader) fetch(accept func(path string) error) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, d.url, nil)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(d.target); err == nil {
+		if d.etag != "" {
+			req.Header.Set("If-None-Match", d.etag)
+		}
+		if d.lastModified != "" {
+			req.Header.Set("If-Modified-Since", d.lastModified)
+		}
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to download `%s`: %s", d.url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("failed to download `%s`: %s", d.url, resp.Status)
+	}
+
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxDownloadSize+1))
+	if err != nil {
+		return false, fmt.Errorf("failed to download `%s`: %s", d.url, err)
+	}
+	if len(content) > maxDownloadSize {
+		return false, fmt.Errorf("`%s` is larger than %d bytes", d.url, maxDownloadSize)
+	}
+
+	if current, err := os.ReadFile(d.target); err == nil && bytes.Equal(current, content) {
+		// already on disk, only the conditional request state was missing
+		d.etag = resp.Header.Get("ETag")
+		d.lastModified = resp.Header.Get("Last-Modified")
+		return false, nil
+	}
+	if err := d.verify(content); err != nil {
+		return false, err
+	}
+	if err := validateDatabase(content); err != nil {
+		return false, fmt.Errorf("invalid database file from `%s`: %s", d.url, err)
+	}
+	if err := d.replace(content, accept); err != nil {
+		return false, err
+	}
+
+	d.etag = resp.Header.Get("ETag")
+	d.lastModified = resp.Header.Get("Last-Modified")
+	return true, nil
+}
+
+// replace writes content over target. With accept the file is staged next to target
+// first, a file the entry cannot load never replaces the last good one.
+func (d *downloader) replace(content []byte, accept func(path string) error) error {
+	if accept == nil {
+		return writeFileAtomic(d.target, content)
+	}
+
+	staging := d.target + ".download"
+	if err := writeFileAtomic(staging, content); err != nil {
+		return err
+	}
+	defer os.Remove(staging)
+
+	if err := accept(staging); err != nil {
+		return fmt.Errorf("unusable database file from `%s`: %s", d.url, err)
+	}
+	if err := os.Rename(staging, d.target); err != nil {
+		return fmt.Errorf("failed to replace `%s`: %s", d.target, err)
+	}
+	return nil
+}
+
+// verify compares the checksum of content with the configured or detached one
+func (d *downloader) verify(content []byte) error {
+	expected := d.sha256
+	if d.sha256URL != "" {
+		var err error
+		expected, err = d.fetchChecksum()
+		if err != nil {
+			return err
+		}
+	}
+	if expected == "" {
+		return nil
+	}
+
+	sum := sha256.Sum256(content)
+	if actual := hex.EncodeToString(sum[:]); actual != expected {
+		return fmt.Errorf("checksum mismatch for `%s`: expected %s, got %s", d.url, expected, actual)
+	}
+	return nil
+}
+
+// fetchChecksum reads the first field of a sha256sum style file
+func (d *downloader) fetchChecksum() (string, error) {
+	resp, err := d.client.Get(d.sha256URL)
+	if err != nil {
+		return "", fmt.Errorf("failed to download checksum `%s`: %s", d.sha256URL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download checksum `%s`: %s", d.sha256URL, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", fmt.Errorf("failed to download checksum `%s`: %s", d.sha256URL, err)
+	}
+
+	fields := strings.Fields(string(body))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty checksum file `%s`", d.sha256URL)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// writeFileAtomic writes content next to path and renames it into place
+func writeFileAtomic(path string, content []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create `%s`: %s", dir, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, ".ip2region-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create a temporary file in `%s`: %s", dir, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, bytes.NewReader(content)); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write `%s`: %s", tmp.Name(), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write `%s`: %s", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write `%s`: %s", tmp.Name(), err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace `%s`: %s", path, err)
+	}
+	return nil
+}
+
+// downloadLoop fetches the database on schedule and swaps it in after every new download.
+// now checks the server once right away, the file on disk may be older than the last release.
+func (e *dbEntry) downloadLoop(d *downloader, stopCh chan struct{}, now bool) {
+	if now {
+		e.download(d)
+	}
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			e.download(d)
+		}
+	}
+}
+
+// download fetches once and loads the new file, the last good file stays on failure
+func (e *dbEntry) download(d *downloader) {
+	etag, lastModified := d.etag, d.lastModified
+	changed, err := d.fetch(func(path string) error { return checkDatabase(path, e.options()) })
+	if err != nil {
+		log.Printf("ip2region: %s, keeping the current database", err)
+		return
+	}
+	if !changed && e.loaded() {
+		return
+	}
+
+	if err := e.load(); err != nil {
+		// the server must send the file again next time
+		d.etag, d.lastModified = etag, lastModified
+		log.Printf("ip2region: failed to load the downloaded `%s`: %s", e.path, err)
+		return
+	}
+	log.Printf("ip2region: downloaded `%s` from `%s`, version %d", e.path, d.url, e.info().Version)
+}
@@ -0,0 +1,231 @@
+package traefik_ip2region
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// xdbServer serves an xdb file with an ETag and its detached checksum
+type xdbServer struct {
+	mu       sync.Mutex
+	content  []byte
+	checksum string
+	etag     string
+	requests int
+}
+
+func (s *xdbServer) set(content []byte, etag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sum := sha256.Sum256(content)
+	s.content, s.checksum, s.etag = content, hex.EncodeToString(sum[:]), etag
+}
+
+func (s *xdbServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if req.URL.Path == "/ip2region.xdb.sha256" {
+		_, _ = rw.Write([]byte(s.checksum + "  ip2region.xdb\n"))
+		return
+	}
+
+	s.requests++
+	if req.Header.Get("If-None-Match") == s.etag {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	rw.Header().Set("ETag", s.etag)
+	_, _ = rw.Write(s.content)
+}
+
+func TestDownload(t *testing.T) {
+	xs := &xdbServer{}
+	xs.set(buildTestXdb(t, testRanges), `"v1"`)
+	server := httptest.NewServer(xs)
+	defer server.Close()
+
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+	d, err := newDownloader(Download{
+		URL:       server.URL + "/ip2region.xdb",
+		SHA256URL: server.URL + "/ip2region.xdb.sha256",
+		CacheDir:  cacheDir,
+	}, "/plugins-local/config/ip2region.xdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.target != filepath.Join(cacheDir, "ip2region.xdb") {
+		t.Fatalf("invalid target: %s", d.target)
+	}
+
+	// the first download happens before the database is loaded
+	e, err := registry.acquire(d.target, dbOptions{ipVersion: ipv4VersionNo, download: d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(e)
+
+	if region, _, _ := e.search("1.1.1.1"); region != "澳大利亚|0|0|0|0" {
+		t.Fatalf("invalid region: %s", region)
+	}
+
+	// not modified
+	e.download(d)
+	if v := e.info().Version; v != 1 {
+		t.Fatalf("unchanged file was reloaded, version: %d", v)
+	}
+
+	// a new file is swapped in
+	xs.set(buildTestXdb(t, []testRange{{"1.1.1.0", "1.1.1.255", "新西兰|0|0|0|0"}}), `"v2"`)
+	e.download(d)
+	if region, _, _ := e.search("1.1.1.1"); region != "新西兰|0|0|0|0" {
+		t.Fatalf("invalid region after download: %s", region)
+	}
+
+	// a broken file keeps the last good one
+	xs.set([]byte("broken"), `"v3"`)
+	e.download(d)
+	if region, _, _ := e.search("1.1.1.1"); region != "新西兰|0|0|0|0" {
+		t.Fatalf("invalid region after a failed download: %s", region)
+	}
+	if v := e.info().Version; v != 2 {
+		t.Fatalf("invalid version: %d", v)
+	}
+}
+
+func TestDownloadChecksumMismatch(t *testing.T) {
+	xs := &xdbServer{}
+	xs.set(buildTestXdb(t, testRanges), `"v1"`)
+	server := httptest.NewServer(xs)
+	defer server.Close()
+
+	target := filepath.Join(t.TempDir(), "ip2region.xdb")
+	d, err := newDownloader(Download{URL: server.URL + "/ip2region.xdb", SHA256: "00"}, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.fetch(nil); err == nil {
+		t.Fatal("expected a checksum error")
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Fatal("file with a wrong checksum was written")
+	}
+}
+
+func TestDownloadSharedPath(t *testing.T) {
+	xs := &xdbServer{}
+	xs.set(buildTestXdb(t, testRanges), `"v1"`)
+	server := httptest.NewServer(xs)
+	defer server.Close()
+
+	path := writeTestXdb(t, testRanges)
+	plain, err := registry.acquire(path, dbOptions{ipVersion: ipv4VersionNo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(plain)
+
+	// an instance downloading the same file gets its own downloader
+	d, err := newDownloader(Download{URL: server.URL + "/ip2region.xdb"}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, err := registry.acquire(path, dbOptions{ipVersion: ipv4VersionNo, download: d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(downloaded)
+	if downloaded == plain || downloaded.downloadCh == nil {
+		t.Fatal("download settings ignored for a shared path")
+	}
+
+	// a second URL must not overwrite the file of the first one
+	other, err := newDownloader(Download{URL: server.URL + "/other.xdb"}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, err := registry.acquire(path, dbOptions{ipVersion: ipv4VersionNo, download: other}); err == nil {
+		registry.release(e)
+		t.Fatal("conflicting download settings accepted")
+	}
+}
+
+func TestDownloadUnusable(t *testing.T) {
+	xs := &xdbServer{}
+	xs.set(buildTestXdb(t, testRanges), `"v1"`)
+	server := httptest.NewServer(xs)
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "ip2region.xdb")
+	d, err := newDownloader(Download{URL: server.URL + "/ip2region.xdb"}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := registry.acquire(path, dbOptions{ipVersion: ipv4VersionNo, download: d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(e)
+	good, _ := os.ReadFile(path)
+
+	// a valid IPv6 file cannot serve the IPv4 entry
+	v6, err := os.ReadFile(writeTestXdbV6(t, testRangesV6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	xs.set(v6, `"v2"`)
+	e.download(d)
+	if content, _ := os.ReadFile(path); !bytes.Equal(content, good) {
+		t.Fatal("unusable file replaced the last good one")
+	}
+	if d.etag != `"v1"` {
+		t.Errorf("etag of the unusable file kept: %s", d.etag)
+	}
+
+	// fixed on the server under the same etag, downloaded again
+	xs.set(buildTestXdb(t, []testRange{{"1.1.1.0", "1.1.1.255", "新西兰|0|0|0|0"}}), `"v2"`)
+	e.download(d)
+	if region, _, _ := e.search("1.1.1.1"); region != "新西兰|0|0|0|0" {
+		t.Errorf("invalid region after the fix: %s", region)
+	}
+}
+
+func TestDownloadAtStart(t *testing.T) {
+	xs := &xdbServer{}
+	xs.set(buildTestXdb(t, []testRange{{"1.1.1.0", "1.1.1.255", "新西兰|0|0|0|0"}}), `"v2"`)
+	server := httptest.NewServer(xs)
+	defer server.Close()
+
+	// the file on disk is older than the one on the server
+	path := writeTestXdb(t, testRanges)
+	d, err := newDownloader(Download{URL: server.URL + "/ip2region.xdb"}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := registry.acquire(path, dbOptions{ipVersion: ipv4VersionNo, download: d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(e)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for e.info().Version < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("database was not downloaded at start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if region, _, _ := e.search("1.1.1.1"); region != "新西兰|0|0|0|0" {
+		t.Errorf("invalid region after download: %s", region)
+	}
+}
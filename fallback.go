@@ -0,0 +1,159 @@
+package traefik_ip2region
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// providerOverlay a CSV file in the overlayPath format used as a fallback provider
+const providerOverlay = "overlay"
+
+// geoFieldNames the fields of 国家|区域|省份|城市|ISP as reported in the geoFields header
+var geoFieldNames = []string{"country", "region", "province", "city", "isp"}
+
+// GeoProvider one database of the provider chain
+type GeoProvider struct {
+	// Name identifies the provider in the geoFields header, the type by default
+	Name string `yaml:"name,omitempty"`
+	// Type xdb, mmdb, text or overlay
+	Type string `yaml:"type"`
+	Path string `yaml:"path"`
+	// Mmdb options of an mmdb provider
+	Mmdb Mmdb `yaml:"mmdb"`
+}
+
+// fallbackProvider fills the fields earlier providers left empty or 0
+type fallbackProvider struct {
+	name    string
+	db      *dbEntry
+	overlay *overlay
+}
+
+// newFallbackProviders loads the provider chain in order, opts are those of DBPath
+func newFallbackProviders(cfgs []GeoProvider, opts dbOptions) ([]fallbackProvider, error) {
+	var providers []fallbackProvider
+	for i, cfg := range cfgs {
+		p := fallbackProvider{name: cfg.Name}
+		if p.name == "" {
+			p.name = cfg.Type
+		}
+		if cfg.Path == "" {
+			releaseFallbackProviders(providers)
+			return nil, fmt.Errorf("provider %d (%s) needs a path", i, p.name)
+		}
+
+		var err error
+		switch cfg.Type {
+		case providerXdb, providerMmdb, providerText:
+			popts := opts
+			// any address family, lookups of the other one are skipped
+			popts.ipVersion = 0
+			popts.provider = cfg.Type
+			popts.mmdb = cfg.Mmdb
+			popts.download = nil
+			popts.inline = nil
+			if cfg.Type != providerXdb {
+				popts.cachePolicy = cachePolicyContent
+			}
+			p.db, err = registry.acquire(cfg.Path, popts)
+		case providerOverlay:
+			p.overlay, err = overlays.acquire(cfg.Path, opts.reloadInterval)
+		default:
+			err = fmt.Errorf("unknown provider type `%s`", cfg.Type)
+		}
+		if err != nil {
+			releaseFallbackProviders(providers)
+			return nil, err
+		}
+		providers = append(providers, p)
+	}
+	return providers, nil
+}
+
+// releaseFallbackProviders drops the databases and overlays held by providers
+func releaseFallbackProviders(providers []fallbackProvider) {
+	for _, p := range providers {
+		if p.db != nil {
+			registry.release(p.db)
+		}
+		overlays.release(p.overlay)
+	}
+}
+
+// lookup returns 国家|区域|省份|城市|ISP, nil when the provider has no answer
+func (p fallbackProvider) lookup(ipStr string) []string {
+	if p.overlay != nil {
+		data, _ := p.overlay.lookup(ipStr)
+		return data
+	}
+
+	addr, err := netip.ParseAddr(ipStr)
+	if err != nil {
+		return nil
+	}
+	ipVersion := ipv4VersionNo
+	if addr.Is6() && !addr.Is4In6() {
+		ipVersion = ipv6VersionNo
+	}
+	if !p.db.supports(ipVersion) {
+		return nil
+	}
+
+	region, _, err := p.db.search(ipStr)
+	if err != nil {
+		return nil
+	}
+	data := strings.Split(region, "|")
+	if len(data) < len(geoFieldNames) {
+		return nil
+	}
+	return data
+}
+
+// fallback fills the unknown fields of geo from the provider chain, first answer wins
+func (a *TraefikIp2Region) fallback(geo *geoResult, ipStr string) {
+	geo.fields = make([]string, len(geo.data))
+	// fields beyond 国家|区域|省份|城市|ISP are kept but never filled
+	fields := len(geoFieldNames)
+	if len(geo.data) < fields {
+		fields = len(geo.data)
+	}
+	missing := 0
+	for i, v := range geo.data {
+		if knownValue(v) {
+			geo.fields[i] = geo.source
+		} else if i < fields {
+			missing++
+		}
+	}
+
+	for _, p := range a.providers {
+		if missing == 0 {
+			return
+		}
+
+		data := p.lookup(ipStr)
+		if data == nil {
+			continue
+		}
+		for i := 0; i < fields; i++ {
+			if !knownValue(geo.data[i]) && knownValue(data[i]) {
+				geo.data[i] = data[i]
+				geo.fields[i] = p.name
+				missing--
+			}
+		}
+	}
+}
+
+// fieldSources describes the provider of every known field, e.g. country=xdb; city=mmdb
+func (g geoResult) fieldSources() string {
+	var sources []string
+	for i, name := range g.fields {
+		if name != "" && i < len(geoFieldNames) {
+			sources = append(sources, geoFieldNames[i]+"="+name)
+		}
+	}
+	return strings.Join(sources, "; ")
+}
@@ -0,0 +1,81 @@
+package traefik_ip2region
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProviderChain(t *testing.T) {
+	overlayPath := filepath.Join(t.TempDir(), "isp.csv")
+	if err := os.WriteFile(overlayPath, []byte("1.1.1.0/24,0,0,0,0,APNIC Research\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := CreateConfig()
+	cfg.DBPath = writeTestXdb(t, testRanges)
+	cfg.Providers = []GeoProvider{
+		{Type: providerMmdb, Path: writeTestMmdb(t, testMmdbRecords), Mmdb: Mmdb{Language: "de"}},
+		{Name: "isp", Type: providerOverlay, Path: overlayPath},
+	}
+	cfg.Headers.Country = "X-Ip2region-Country"
+	cfg.Headers.Province = "X-Ip2region-Province"
+	cfg.Headers.City = "X-Ip2region-City"
+	cfg.Headers.ISP = "X-Ip2region-Isp"
+	cfg.Headers.GeoFields = "X-Ip2region-Fields"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := New(context.Background(), next, cfg, "demo-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.(*TraefikIp2Region).Close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "1.1.1.1:4711"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, "X-Ip2region-Country", "澳大利亚")
+	assertHeader(t, req, "X-Ip2region-Province", "Queensland")
+	assertHeader(t, req, "X-Ip2region-City", "Brisbane-de")
+	assertHeader(t, req, "X-Ip2region-Isp", "APNIC Research")
+	assertHeader(t, req, "X-Ip2region-Fields", "country=xdb; province=mmdb; city=mmdb; isp=isp")
+
+	// fields no provider knows are not reported
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "8.8.8.8:4711"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, "X-Ip2region-Isp", "Level3")
+	assertHeader(t, req, "X-Ip2region-Fields", "country=xdb; isp=xdb")
+}
+
+func TestProviderChainExtraFields(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DBPath = writeTestXdb(t, []testRange{{"1.1.1.0", "1.1.1.255", "澳大利亚|0|0|0|0|0"}})
+	cfg.Providers = []GeoProvider{{Type: providerText, Path: writeTestText(t, []testRange{{"1.1.1.0", "1.1.1.255", "0|0|0|0|APNIC"}})}}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := New(context.Background(), next, cfg, "demo-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.(*TraefikIp2Region).Close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "1.1.1.1:4711"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, "X-Ip2region-Country", "澳大利亚")
+	assertHeader(t, req, "X-Ip2region-Isp", "APNIC")
+}
+
+func TestProviderChainInvalid(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DBPath = writeTestXdb(t, testRanges)
+	cfg.Providers = []GeoProvider{{Type: "csv", Path: "ranges.csv"}}
+
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "demo-plugin"); err == nil {
+		t.Error("unknown provider type accepted")
+	}
+}
@@ -0,0 +1,214 @@
+package traefik_ip2region
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/lionsoul2014/ip2region/binding/golang/xdb"
+)
+
+// testRange one line of ip2region source data
+type testRange struct {
+	start  string
+	end    string
+	region string
+}
+
+// testRanges covers the addresses used across the tests
+var testRanges = []testRange{
+	{"1.1.1.0", "1.1.1.255", "澳大利亚|0|0|0|0"},
+	{"8.8.8.0", "8.8.8.255", "美国|0|0|0|Level3"},
+	{"36.0.0.0", "36.255.255.255", "中国|0|北京|北京市|电信"},
+	{"223.5.5.0", "223.5.5.255", "中国|0|浙江省|杭州市|阿里云"},
+}
+
+// writeTestXdb builds a v2 xdb file from ranges, gaps are filled with an empty region.
+func writeTestXdb(t *testing.T, ranges []testRange) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "test.xdb")
+	if err := os.WriteFile(path, buildTestXdb(t, ranges), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func buildTestXdb(t *testing.T, ranges []testRange) []byte {
+	t.Helper()
+
+	type segment struct {
+		sip, eip uint32
+		region   string
+	}
+
+	var segs []segment
+	for _, r := range ranges {
+		sip, err := xdb.CheckIP(r.start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eip, err := xdb.CheckIP(r.end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segs = append(segs, segment{sip, eip, r.region})
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].sip < segs[j].sip })
+
+	// fill the gaps so that every address resolves
+	var full []segment
+	next := uint64(0)
+	for _, s := range segs {
+		if uint64(s.sip) > next {
+			full = append(full, segment{uint32(next), s.sip - 1, "0|0|0|0|0"})
+		}
+		full = append(full, s)
+		next = uint64(s.eip) + 1
+	}
+	if next <= 0xFFFFFFFF {
+		full = append(full, segment{uint32(next), 0xFFFFFFFF, "0|0|0|0|0"})
+	}
+
+	// split on /16 boundaries as required by the vector index
+	var split []segment
+	for _, s := range full {
+		for sip := uint64(s.sip); sip <= uint64(s.eip); {
+			eip := sip | 0xFFFF
+			if eip > uint64(s.eip) {
+				eip = uint64(s.eip)
+			}
+			split = append(split, segment{uint32(sip), uint32(eip), s.region})
+			sip = eip + 1
+		}
+	}
+
+	vectorLen := xdb.VectorIndexRows * xdb.VectorIndexCols * xdb.VectorIndexSize
+	buf := make([]byte, xdb.HeaderInfoLength+vectorLen)
+
+	// region data
+	regionPtr := map[string]uint32{}
+	for _, s := range split {
+		if _, ok := regionPtr[s.region]; !ok {
+			regionPtr[s.region] = uint32(len(buf))
+			buf = append(buf, s.region...)
+		}
+	}
+
+	// segment index and vector index
+	startPtr := uint32(len(buf))
+	block := make([]byte, xdb.SegmentIndexBlockSize)
+	for _, s := range split {
+		ptr := uint32(len(buf))
+		binary.LittleEndian.PutUint32(block, s.sip)
+		binary.LittleEndian.PutUint32(block[4:], s.eip)
+		binary.LittleEndian.PutUint16(block[8:], uint16(len(s.region)))
+		binary.LittleEndian.PutUint32(block[10:], regionPtr[s.region])
+		buf = append(buf, block...)
+
+		idx := xdb.HeaderInfoLength + int((s.sip>>24)&0xFF)*xdb.VectorIndexCols*xdb.VectorIndexSize + int((s.sip>>16)&0xFF)*xdb.VectorIndexSize
+		if binary.LittleEndian.Uint32(buf[idx:]) == 0 {
+			binary.LittleEndian.PutUint32(buf[idx:], ptr)
+		}
+		binary.LittleEndian.PutUint32(buf[idx+4:], ptr+xdb.SegmentIndexBlockSize)
+	}
+
+	// header
+	binary.LittleEndian.PutUint16(buf, 2)
+	binary.LittleEndian.PutUint16(buf[2:], uint16(xdb.VectorIndexPolicy))
+	binary.LittleEndian.PutUint32(buf[4:], 1700000000)
+	binary.LittleEndian.PutUint32(buf[8:], startPtr)
+	binary.LittleEndian.PutUint32(buf[12:], uint32(len(buf))-xdb.SegmentIndexBlockSize)
+	return buf
+}
+
+// writeTestXdbV6 builds a v3 IPv6 xdb file from ranges, gaps are filled with an empty region.
+func writeTestXdbV6(t *testing.T, ranges []testRange) string {
+	t.Helper()
+
+	type segment struct {
+		sip, eip netip.Addr
+		region   string
+	}
+
+	var segs []segment
+	for _, r := range ranges {
+		segs = append(segs, segment{netip.MustParseAddr(r.start), netip.MustParseAddr(r.end), r.region})
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].sip.Less(segs[j].sip) })
+
+	// fill the gaps and split on /16 boundaries
+	var split []segment
+	add := func(sip, eip netip.Addr, region string) {
+		for {
+			b := sip.As16()
+			for i := 2; i < 16; i++ {
+				b[i] = 0xFF
+			}
+			blockEnd := netip.AddrFrom16(b)
+			if !blockEnd.Less(eip) {
+				split = append(split, segment{sip, eip, region})
+				return
+			}
+			split = append(split, segment{sip, blockEnd, region})
+			sip = blockEnd.Next()
+		}
+	}
+	next := netip.IPv6Unspecified()
+	for _, s := range segs {
+		if next.Less(s.sip) {
+			add(next, s.sip.Prev(), "0|0|0|0|0")
+		}
+		add(s.sip, s.eip, s.region)
+		next = s.eip.Next()
+	}
+	if next.IsValid() {
+		add(next, netip.MustParseAddr("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"), "0|0|0|0|0")
+	}
+
+	vectorLen := xdb.VectorIndexRows * xdb.VectorIndexCols * xdb.VectorIndexSize
+	buf := make([]byte, xdb.HeaderInfoLength+vectorLen)
+
+	regionPtr := map[string]uint32{}
+	for _, s := range split {
+		if _, ok := regionPtr[s.region]; !ok {
+			regionPtr[s.region] = uint32(len(buf))
+			buf = append(buf, s.region...)
+		}
+	}
+
+	startPtr := uint32(len(buf))
+	block := make([]byte, ipv6SegmentIndexBlockSize)
+	for _, s := range split {
+		ptr := uint32(len(buf))
+		sip, eip := s.sip.As16(), s.eip.As16()
+		copy(block, sip[:])
+		copy(block[16:], eip[:])
+		binary.LittleEndian.PutUint16(block[32:], uint16(len(s.region)))
+		binary.LittleEndian.PutUint32(block[34:], regionPtr[s.region])
+		buf = append(buf, block...)
+
+		idx := xdb.HeaderInfoLength + int(sip[0])*xdb.VectorIndexCols*xdb.VectorIndexSize + int(sip[1])*xdb.VectorIndexSize
+		if binary.LittleEndian.Uint32(buf[idx:]) == 0 {
+			binary.LittleEndian.PutUint32(buf[idx:], ptr)
+		}
+		binary.LittleEndian.PutUint32(buf[idx+4:], ptr+ipv6SegmentIndexBlockSize)
+	}
+
+	binary.LittleEndian.PutUint16(buf, xdbStructure30)
+	binary.LittleEndian.PutUint16(buf[2:], uint16(xdb.VectorIndexPolicy))
+	binary.LittleEndian.PutUint32(buf[4:], 1700000000)
+	binary.LittleEndian.PutUint32(buf[8:], startPtr)
+	binary.LittleEndian.PutUint32(buf[12:], uint32(len(buf))-ipv6SegmentIndexBlockSize)
+	binary.LittleEndian.PutUint16(buf[16:], ipv6VersionNo)
+	binary.LittleEndian.PutUint16(buf[18:], 4)
+
+	path := filepath.Join(t.TempDir(), "test_v6.xdb")
+	if err := os.WriteFile(path, buf, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
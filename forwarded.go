@@ -0,0 +1,123 @@
+package traefik_ip2region
+
+import (
+	"net/http"
+	"strings"
+)
+
+// forwardedHeader the RFC 7239 header name
+const forwardedHeader = "Forwarded"
+
+// forwardedElement one proxy hop of a Forwarded header
+type forwardedElement struct {
+	For   string
+	By    string
+	Host  string
+	Proto string
+}
+
+// parseForwarded parses RFC 7239 Forwarded header values into their elements in order.
+// Malformed pairs are skipped, quoted strings may contain commas and semicolons.
+func parseForwarded(values []string) []forwardedElement {
+	var elements []forwardedElement
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			var e forwardedElement
+			for _, pair := range splitQuoted(element, ';') {
+				name, val, ok := strings.Cut(pair, "=")
+				if !ok {
+					continue
+				}
+				val = unquote(strings.TrimSpace(val))
+
+				switch strings.ToLower(strings.TrimSpace(name)) {
+				case "for":
+					e.For = val
+				case "by":
+					e.By = val
+				case "host":
+					e.Host = val
+				case "proto":
+					e.Proto = strings.ToLower(val)
+				}
+			}
+			elements = append(elements, e)
+		}
+	}
+	return elements
+}
+
+// forwardedFor returns the for= node of every element of an RFC 7239 header, left to right.
+// Addresses are stripped of brackets and ports, `unknown` and obfuscated
+// identifiers are kept so that they still count as a hop.
+func forwardedFor(req *http.Request, header string) []string {
+	var chain []string
+	for _, e := range parseForwarded(req.Header.Values(header)) {
+		if e.For == "" {
+			continue
+		}
+		chain = append(chain, forwardedNodeIP(e.For))
+	}
+	return chain
+}
+
+// forwardedNodeIP extracts the address of a node: 1.2.3.4, 1.2.3.4:80, "[2001:db8::1]:4711"
+func forwardedNodeIP(node string) string {
+	if strings.HasPrefix(node, "[") {
+		if end := strings.IndexByte(node, ']'); end > 0 {
+			return node[1:end]
+		}
+		return node
+	}
+
+	// an IPv4 address or an identifier with an optional port
+	if host, _, ok := strings.Cut(node, ":"); ok && strings.Count(node, ":") == 1 {
+		return host
+	}
+	return node
+}
+
+// splitQuoted splits s on sep outside of quoted strings and trims the parts
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			if part := strings.TrimSpace(s[start:i]); part != "" {
+				parts = append(parts, part)
+			}
+			start = i + 1
+		}
+	}
+	if part := strings.TrimSpace(s[start:]); part != "" {
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// unquote removes the quotes and escapes of a quoted-string
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+
+	s = s[1 : len(s)-1]
+	var b strings.Builder
+	escaped := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,62 @@
+package traefik_ip2region
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseForwarded(t *testing.T) {
+	elements := parseForwarded([]string{
+		`for="[2001:db8::1]:4711";proto=https;by=203.0.113.43, for=192.0.2.60;host="example.com"`,
+		`For="_hidden, not a separator", for=unknown`,
+	})
+
+	expected := []forwardedElement{
+		{For: "[2001:db8::1]:4711", By: "203.0.113.43", Proto: "https"},
+		{For: "192.0.2.60", Host: "example.com"},
+		{For: "_hidden, not a separator"},
+		{For: "unknown"},
+	}
+	if !reflect.DeepEqual(elements, expected) {
+		t.Errorf("invalid elements: %+v", elements)
+	}
+}
+
+func TestForwardedNodeIP(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.43":         "192.0.2.43",
+		"192.0.2.43:47011":   "192.0.2.43",
+		"[2001:db8::1]":      "2001:db8::1",
+		"[2001:db8::1]:4711": "2001:db8::1",
+		"2001:db8::1":        "2001:db8::1",
+		"unknown":            "unknown",
+		"_hidden:_port":      "_hidden",
+	}
+
+	for in, expected := range tests {
+		if ip := forwardedNodeIP(in); ip != expected {
+			t.Errorf("forwardedNodeIP(%s) = %s, want %s", in, ip, expected)
+		}
+	}
+}
+
+func TestGetClientIPForwarded(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "10.0.0.1:9999"
+	req.Header.Add("Forwarded", `for=1.1.1.1, for="[2001:db8::1]:4711";proto=https`)
+	req.Header.Add("Forwarded", `for=10.1.1.1:8080`)
+
+	if ip := getClientIP(req, "Forwarded", trusted); ip != "2001:db8::1" {
+		t.Errorf("invalid client ip: %s", ip)
+	}
+	if ip := getClientIP(req, "forwarded", nil); ip != "1.1.1.1" {
+		t.Errorf("invalid client ip: %s", ip)
+	}
+}
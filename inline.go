@@ -0,0 +1,78 @@
+package traefik_ip2region
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// maxInlineSize bounds the decoded size of an inline database
+const maxInlineSize = 4 << 20
+
+// Inline part of the configuration, a small database carried in the dynamic configuration
+type Inline struct {
+	// Xdb a base64 encoded xdb file
+	Xdb string `yaml:"xdb,omitempty"`
+	// Ranges ip2region source data, one startIP|endIP|country|region|province|city|isp per line
+	Ranges string `yaml:"ranges,omitempty"`
+}
+
+// inlineSource the decoded inline database
+type inlineSource struct {
+	format  string
+	content []byte
+}
+
+// decodeInline returns nil when no inline database is configured
+func decodeInline(cfg Inline) (*inlineSource, error) {
+	switch {
+	case cfg.Xdb == "" && cfg.Ranges == "":
+		return nil, nil
+	case cfg.Xdb != "" && cfg.Ranges != "":
+		return nil, fmt.Errorf("inline xdb and ranges cannot be used together")
+	case cfg.Ranges != "":
+		if len(cfg.Ranges) > maxInlineSize {
+			return nil, fmt.Errorf("inline ranges are larger than %d bytes", maxInlineSize)
+		}
+		return &inlineSource{format: dbFormatText, content: []byte(cfg.Ranges)}, nil
+	}
+
+	// line breaks are common when the value comes from a YAML block scalar
+	encoded := strings.Join(strings.Fields(cfg.Xdb), "")
+	if base64.StdEncoding.DecodedLen(len(encoded)) > maxInlineSize+2 {
+		return nil, fmt.Errorf("inline xdb is larger than %d bytes", maxInlineSize)
+	}
+	content, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid inline xdb: %s", err)
+	}
+	if len(content) > maxInlineSize {
+		return nil, fmt.Errorf("inline xdb is larger than %d bytes", maxInlineSize)
+	}
+	return &inlineSource{format: dbFormatXdb, content: content}, nil
+}
+
+// name identifies the inline database in place of a path, equal content shares an entry
+func (s *inlineSource) name() string {
+	sum := sha256.Sum256(s.content)
+	return "inline:" + hex.EncodeToString(sum[:8])
+}
+
+// load builds the searcher from the decoded content
+func (s *inlineSource) load() (ipSearcher, *dbMeta, error) {
+	if s.format == dbFormatText {
+		searcher, err := parseTextSource(strings.NewReader(string(s.content)))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid inline ranges: %s", err)
+		}
+		return searcher, &dbMeta{Format: dbFormatText, IPVersion: searcher.ipVersion}, nil
+	}
+
+	searcher, header, err := newContentSearcher(s.content)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid inline xdb: %s", err)
+	}
+	return searcher, header.meta(), nil
+}
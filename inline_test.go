@@ -0,0 +1,66 @@
+package traefik_ip2region
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInlineDatabase(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString(buildTestXdb(t, testRanges))
+	// wrapped like a YAML block scalar
+	var wrapped strings.Builder
+	for len(encoded) > 76 {
+		wrapped.WriteString(encoded[:76] + "\n")
+		encoded = encoded[76:]
+	}
+	wrapped.WriteString(encoded)
+
+	tests := map[string]Inline{
+		"xdb":    {Xdb: wrapped.String()},
+		"ranges": {Ranges: "# office\n223.5.5.0|223.5.5.255|中国|0|浙江省|杭州市|阿里云\n"},
+	}
+	for name, inline := range tests {
+		cfg := CreateConfig()
+		cfg.DBPath = "/does/not/exist.xdb"
+		cfg.Inline = inline
+		cfg.Headers.City = "X-Ip2region-City"
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+		handler, err := New(context.Background(), next, cfg, "demo-plugin")
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = "223.5.5.5:4711"
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, "X-Ip2region-City", "杭州市")
+
+		if info := handler.(*TraefikIp2Region).db.info(); !strings.HasPrefix(info.Path, "inline:") {
+			t.Errorf("%s: path %s", name, info.Path)
+		}
+		handler.(*TraefikIp2Region).Close()
+	}
+}
+
+func TestInlineInvalid(t *testing.T) {
+	tests := map[string]Inline{
+		"both":    {Xdb: "AAAA", Ranges: "1.0.0.0|1.0.0.255|a|0|0|0|0"},
+		"base64":  {Xdb: "not base64!"},
+		"xdb":     {Xdb: base64.StdEncoding.EncodeToString([]byte("too small"))},
+		"ranges":  {Ranges: "1.0.0.0|a|0"},
+		"toolong": {Ranges: strings.Repeat("#", maxInlineSize+1)},
+	}
+	for name, inline := range tests {
+		cfg := CreateConfig()
+		cfg.Inline = inline
+		cfg.OnDBError = onDBErrorFailOpen
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "demo-plugin"); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
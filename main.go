@@ -4,17 +4,16 @@ package traefik_ip2region
 import (
 	"context"
 	"fmt"
-	"net"
 	"net/http"
+	"net/netip"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
-	"github.com/lionsoul2014/ip2region/binding/golang/xdb"
 	goUserAgent "github.com/medama-io/go-useragent"
 )
 
-// searcher cached
-var searcher *xdb.Searcher
-
 var ua = goUserAgent.NewParser()
 
 // Headers part of the configuration
@@ -23,6 +22,26 @@ type Headers struct {
 	Province string `yaml:"province"`
 	City     string `yaml:"city"`
 	ISP      string `yaml:"isp"`
+	// optional, the version and load time of the database in use
+	DBVersion  string `yaml:"dbVersion,omitempty"`
+	DBLoadedAt string `yaml:"dbLoadedAt,omitempty"`
+	// optional, the file reads of the lookup, for tuning cachePolicy
+	IOCount string `yaml:"ioCount,omitempty"`
+	// optional, set to true while the database is not loaded
+	Degraded string `yaml:"degraded,omitempty"`
+	// optional, where the geo data came from: the format of the database (xdb, mmdb or text),
+	// overlay or reserved
+	GeoSource string `yaml:"geoSource,omitempty"`
+	// optional, the provider that answered each field, e.g. country=xdb; city=mmdb
+	GeoFields string `yaml:"geoFields,omitempty"`
+	// optional, the header or CDN preset the client address was taken from
+	IPSource string `yaml:"ipSource,omitempty"`
+	// optional, the country of every hop in the forwarding chain, requires strictChain
+	ChainCountries string `yaml:"chainCountries,omitempty"`
+	// optional, the fields that disagree across the forwarding chain, requires chainMismatch
+	ChainMismatch string `yaml:"chainMismatch,omitempty"`
+	// optional, the IPv6 transition mechanism an IPv4 address was extracted from
+	Transition string `yaml:"transition,omitempty"`
 }
 
 // Config the plugin configuration.
@@ -32,6 +51,65 @@ type Config struct {
 	Ban          Rules    `yaml:"ban"`
 	Whitelist    Rules    `yaml:"whitelist"`
 	IpFromHeader string   `yaml:"ipFromHeader,omitempty"`
+	// DBPathV6 optional ip2region IPv6 xdb, IPv6 clients are looked up here
+	DBPathV6 string `yaml:"dbPathV6,omitempty"`
+	// TrustedProxies CIDRs or addresses of proxies allowed to set IpFromHeader
+	TrustedProxies []string `yaml:"trustedProxies,omitempty"`
+	// IpSource a CDN preset: cloudflare or fastly. Replaces IpFromHeader.
+	IpSource string `yaml:"ipSource,omitempty"`
+	// IpSourceRangesFile replaces the bundled ranges of IpSource, one CIDR per line
+	IpSourceRangesFile string `yaml:"ipSourceRangesFile,omitempty"`
+	// ClientIPSources ordered fallback chain, the first valid public address wins.
+	// Replaces IpFromHeader and IpSource.
+	ClientIPSources []ClientIPSource `yaml:"clientIpSources,omitempty"`
+	// InvalidIPAction for a malformed client address: pass (default, no geo data),
+	// remoteAddr (look up RemoteAddr instead) or block (403)
+	InvalidIPAction string `yaml:"invalidIpAction,omitempty"`
+	// Reserved classifies private, loopback, cgnat and other reserved addresses
+	Reserved Reserved `yaml:"reserved"`
+	// StrictChain looks up every untrusted hop of the forwarding chain,
+	// the request is banned when any of them matches the ban rules
+	StrictChain bool `yaml:"strictChain,omitempty"`
+	// ChainMismatch compares the geo data of RemoteAddr with every claimed hop
+	ChainMismatch ChainMismatch `yaml:"chainMismatch"`
+	// CachePolicy content (default) keeps the whole file in memory, vectorIndex only the
+	// vector index, file reads every lookup from disk
+	CachePolicy string `yaml:"cachePolicy,omitempty"`
+	// SearcherPoolSize bounds the concurrent lookups of the vectorIndex and file policies
+	SearcherPoolSize int `yaml:"searcherPoolSize,omitempty"`
+	// OnDBError error (default) fails New when the database cannot be loaded. failOpen and
+	// failClosed start without it, pass or block traffic and keep retrying in the background.
+	OnDBError string `yaml:"onDbError,omitempty"`
+	// Download keeps DBPath up to date from a URL
+	Download Download `yaml:"download"`
+	// StatusPath serves the database metadata as JSON on this path, empty disables it
+	StatusPath string `yaml:"statusPath,omitempty"`
+	// StatusAllowedIPs CIDRs or addresses whose RemoteAddr may read StatusPath.
+	// Empty allows TrustedProxies, or only loopback without them.
+	StatusAllowedIPs []string `yaml:"statusAllowedIps,omitempty"`
+	// MetadataResponseHeader optional response header with the database metadata
+	MetadataResponseHeader string `yaml:"metadataResponseHeader,omitempty"`
+	// MaxDBAge warns when the database was built longer ago, e.g. 2160h
+	MaxDBAge string `yaml:"maxDbAge,omitempty"`
+	// OverlayPath CSV file (cidr,country,region,province,city,isp) checked before the database,
+	// the longest matching prefix wins. Reloaded with ReloadInterval.
+	OverlayPath string `yaml:"overlayPath,omitempty"`
+	// ReloadInterval how often DBPath is checked for changes, e.g. 1m. Empty disables reloading.
+	ReloadInterval string `yaml:"reloadInterval,omitempty"`
+	// Provider the format of DBPath and DBPathV6: xdb, mmdb (MaxMind DB) or text
+	// (ip2region source data). Empty detects mmdb and text files and treats anything else as xdb.
+	Provider string `yaml:"provider,omitempty"`
+	// Mmdb how MaxMind records map onto the headers and rules
+	Mmdb Mmdb `yaml:"mmdb"`
+	// Inline a small database in the configuration, replaces DBPath
+	Inline Inline `yaml:"inline"`
+	// Providers consulted in order after DBPath, each field empty or 0 so far
+	// is filled from the first provider that knows it
+	Providers []GeoProvider `yaml:"providers,omitempty"`
+	// Cache keeps the geo data of recently seen addresses, cleared on every reload
+	Cache Cache `yaml:"cache"`
+	// StrictRules fails New when a ban or whitelist value does not occur in any database
+	StrictRules bool `yaml:"strictRules,omitempty"`
 }
 
 // Rules
@@ -61,226 +139,574 @@ func CreateConfig() *Config {
 	}
 }
 
+// loopbackRanges may read the status when neither statusAllowedIps nor trustedProxies are set
+var loopbackRanges = trustedProxies{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+
+// onDbError values
+const (
+	onDBErrorError      = "error"
+	onDBErrorFailOpen   = "failOpen"
+	onDBErrorFailClosed = "failClosed"
+)
+
 // TraefikIp2Region a Demo plugin.
 type TraefikIp2Region struct {
-	next         http.Handler
-	name         string
-	headers      *Headers
-	ban          Rules
-	whitelist    Rules
-	ipFromHeader string
+	next          http.Handler
+	name          string
+	headers       *Headers
+	ban           Rules
+	whitelist     Rules
+	ipFromHeader  string
+	trusted       trustedProxies
+	cdn           *cdnSource
+	sources       []ClientIPSource
+	invalidIP     string
+	invalidIPs    uint64
+	reserved      *reservedClassifier
+	strictChain   bool
+	chainMismatch *mismatchDetector
+	onDBError     string
+	statusPath    string
+	statusAllowed trustedProxies
+	metaHeader    string
+	staleness     *staleness
+	overlay       *overlay
+	providers     []fallbackProvider
+	cache         *lookupCache
+	db            *dbEntry
+	db6           *dbEntry
 }
 
 // New created a new Demo plugin.
 func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
-	err := loadXdb(config.DBPath)
+	trusted, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	var cdn *cdnSource
+	if config.IpSource != "" {
+		if config.IpFromHeader != "" {
+			return nil, fmt.Errorf("ipSource and ipFromHeader cannot be used together")
+		}
+		cdn, err = newCDNSource(config.IpSource, config.IpSourceRangesFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(config.ClientIPSources) > 0 {
+		if config.IpFromHeader != "" || config.IpSource != "" {
+			return nil, fmt.Errorf("clientIpSources cannot be used together with ipFromHeader or ipSource")
+		}
+		for _, s := range config.ClientIPSources {
+			if err := s.validate(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	switch config.InvalidIPAction {
+	case "", invalidIPPass, invalidIPRemoteAddr, invalidIPBlock:
+	default:
+		return nil, fmt.Errorf("unknown invalidIpAction `%s`", config.InvalidIPAction)
+	}
+
+	reserved, err := newReservedClassifier(config.Reserved)
+	if err != nil {
+		return nil, err
+	}
+
+	chainMismatch, err := newMismatchDetector(config.ChainMismatch)
+	if err != nil {
+		return nil, err
+	}
+
+	var reloadInterval time.Duration
+	if config.ReloadInterval != "" {
+		d, err := time.ParseDuration(config.ReloadInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reloadInterval `%s`: %s", config.ReloadInterval, err)
+		}
+		reloadInterval = d
+	}
+
+	switch config.OnDBError {
+	case "", onDBErrorError, onDBErrorFailOpen, onDBErrorFailClosed:
+	default:
+		return nil, fmt.Errorf("unknown onDbError `%s`", config.OnDBError)
+	}
+
+	staleness, err := newStaleness(config.MaxDBAge)
+	if err != nil {
+		return nil, err
+	}
+
+	statusAllowed := trusted
+	if len(config.StatusAllowedIPs) > 0 {
+		if statusAllowed, err = parseTrustedProxies(config.StatusAllowedIPs); err != nil {
+			return nil, fmt.Errorf("invalid statusAllowedIps: %s", err)
+		}
+	}
+	if len(statusAllowed) == 0 {
+		statusAllowed = loopbackRanges
+	}
+
+	cache, err := newLookupCache(config.Cache)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateProvider(config.Provider, config.CachePolicy); err != nil {
+		return nil, err
+	}
+
+	download, err := newDownloader(config.Download, config.DBPath)
+	if err != nil {
+		return nil, err
+	}
+	dbPath := config.DBPath
+	if download != nil {
+		dbPath = download.target
+	}
+
+	inline, err := decodeInline(config.Inline)
+	if err != nil {
+		return nil, err
+	}
+	if inline != nil {
+		if download != nil {
+			return nil, fmt.Errorf("inline and download cannot be used together")
+		}
+		dbPath = inline.name()
+	}
+
+	allowMissing := config.OnDBError == onDBErrorFailOpen || config.OnDBError == onDBErrorFailClosed
+	opts := dbOptions{
+		download:       download,
+		ipVersion:      ipv4VersionNo,
+		cachePolicy:    config.CachePolicy,
+		poolSize:       config.SearcherPoolSize,
+		provider:       config.Provider,
+		mmdb:           config.Mmdb,
+		reloadInterval: reloadInterval,
+		allowMissing:   allowMissing,
+		maxAge:         staleness.maxAge,
+	}
+	if inline != nil {
+		// an inline database serves the address family it holds and cannot show up later
+		opts.inline = inline
+		opts.ipVersion = 0
+		opts.allowMissing = false
+	}
+	db, err := registry.acquire(dbPath, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var db6 *dbEntry
+	if config.DBPathV6 != "" {
+		opts.ipVersion = ipv6VersionNo
+		opts.download = nil
+		opts.inline = nil
+		opts.allowMissing = allowMissing
+		db6, err = registry.acquire(config.DBPathV6, opts)
+		if err != nil {
+			registry.release(db)
+			return nil, err
+		}
+	}
+
+	providers, err := newFallbackProviders(config.Providers, opts)
 	if err != nil {
+		registry.release(db)
+		if db6 != nil {
+			registry.release(db6)
+		}
 		return nil, err
 	}
 
-	return &TraefikIp2Region{
-		next:         next,
-		name:         name,
-		headers:      config.Headers,
-		ban:          config.Ban,
-		whitelist:    config.Whitelist,
-		ipFromHeader: config.IpFromHeader,
-	}, nil
+	// shared by path, Traefik does not close the instances of an old configuration
+	overlay, err := overlays.acquire(config.OverlayPath, reloadInterval)
+	if err != nil {
+		registry.release(db)
+		if db6 != nil {
+			registry.release(db6)
+		}
+		releaseFallbackProviders(providers)
+		return nil, err
+	}
+
+	a := &TraefikIp2Region{
+		next:          next,
+		name:          name,
+		headers:       config.Headers,
+		ban:           config.Ban,
+		whitelist:     config.Whitelist,
+		ipFromHeader:  config.IpFromHeader,
+		trusted:       trusted,
+		cdn:           cdn,
+		sources:       config.ClientIPSources,
+		invalidIP:     config.InvalidIPAction,
+		reserved:      reserved,
+		strictChain:   config.StrictChain,
+		chainMismatch: chainMismatch,
+		onDBError:     config.OnDBError,
+		statusPath:    config.StatusPath,
+		statusAllowed: statusAllowed,
+		metaHeader:    config.MetadataResponseHeader,
+		staleness:     staleness,
+		db:            db,
+		db6:           db6,
+		overlay:       overlay,
+		providers:     providers,
+		cache:         cache,
+	}
+
+	if err := a.validateRules(config.StrictRules); err != nil {
+		a.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// Close releases the databases and overlays held by this instance.
+// The searcher is dropped once no instance references its file anymore.
+func (a *TraefikIp2Region) Close() error {
+	if a.overlay != nil {
+		overlays.release(a.overlay)
+		a.overlay = nil
+	}
+	if a.db != nil {
+		registry.release(a.db)
+		a.db = nil
+	}
+	if a.db6 != nil {
+		registry.release(a.db6)
+		a.db6 = nil
+	}
+	releaseFallbackProviders(a.providers)
+	a.providers = nil
+	return nil
 }
 
 func (a *TraefikIp2Region) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// anyone else goes through the rules like any other path
+	if a.statusPath != "" && a.statusAllowed.contains(remoteIP(req)) {
+		switch req.URL.Path {
+		case a.statusPath:
+			a.serveStatus(rw)
+			return
+		case a.statusPath + vocabularyPath:
+			a.serveVocabulary(rw)
+			return
+		}
+	}
 
-	ipStr := getClientIP(req, a.ipFromHeader)
+	ipStr, source := a.clientIP(req)
+	if addr, err := normalizeIP(ipStr); err == nil {
+		ipStr = addr.String()
+	} else {
+		atomic.AddUint64(&a.invalidIPs, 1)
+		switch a.invalidIP {
+		case invalidIPBlock:
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		case invalidIPRemoteAddr:
+			ipStr, source = remoteIP(req), sourceModeRemoteAddr
+		}
+	}
+	ipStr, transition := unwrapIPv4(ipStr)
 
-	var data []string = make([]string, 5)
+	db := a.dbFor(ipStr)
+	if a.metaHeader != "" && db != nil {
+		rw.Header().Set(a.metaHeader, a.metadataValue(db))
+	}
 
-	// 国家|区域|省份|城市|ISP
-	region, err := searcher.SearchByStr(ipStr)
-	if err == nil {
-		data = strings.Split(region, "|")
-		if len(data) < 5 {
-			// If the data is not enough, fill it with empty strings
-			data = make([]string, 5)
+	if db != nil && !db.loaded() {
+		if a.headers.Degraded != "" {
+			req.Header.Set(a.headers.Degraded, "true")
+		}
+		if a.onDBError == onDBErrorFailClosed {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
 		}
+		a.next.ServeHTTP(rw, req)
+		return
 	}
 
+	geo := a.lookup(ipStr)
+	data, skipGeo := geo.data, geo.skipGeo
+
 	// add headers
 	// 国家|区域|省份|城市|ISP
 	req.Header.Add(a.headers.Country, data[0])
 	req.Header.Add(a.headers.Province, data[2])
 	req.Header.Add(a.headers.City, data[3])
 	req.Header.Add(a.headers.ISP, data[4])
-
-	// Ban
-	if a.ban.Enabled {
-		// country
-		for _, v := range a.ban.Country {
-			if v == data[0] {
-				rw.WriteHeader(http.StatusForbidden)
-				return
-			}
+	if a.headers.IPSource != "" {
+		req.Header.Set(a.headers.IPSource, source)
+	}
+	if a.headers.GeoSource != "" {
+		req.Header.Set(a.headers.GeoSource, geo.source)
+	}
+	if a.headers.GeoFields != "" {
+		req.Header.Set(a.headers.GeoFields, geo.fieldSources())
+	}
+	if a.headers.IOCount != "" {
+		req.Header.Set(a.headers.IOCount, strconv.Itoa(geo.ioCount))
+	}
+	if a.headers.Transition != "" && transition != "" {
+		req.Header.Set(a.headers.Transition, transition)
+	}
+	// the database of the address family that answered, none for IPv6 without dbPathV6
+	if db != nil && (a.headers.DBVersion != "" || a.headers.DBLoadedAt != "") {
+		info := db.info()
+		if a.headers.DBVersion != "" {
+			req.Header.Set(a.headers.DBVersion, strconv.Itoa(info.Version))
 		}
-
-		// province
-		for _, v := range a.ban.Province {
-			if v == data[2] {
-				rw.WriteHeader(http.StatusForbidden)
-				return
-			}
+		if a.headers.DBLoadedAt != "" {
+			req.Header.Set(a.headers.DBLoadedAt, info.LoadedAt.UTC().Format(time.RFC3339))
 		}
+	}
 
-		// city
-		for _, v := range a.ban.City {
-			if v == data[3] {
-				rw.WriteHeader(http.StatusForbidden)
-				return
-			}
-		}
+	var hops []chainHop
+	if a.strictChain || a.chainMismatch != nil {
+		hops = a.lookupChain(req)
+	}
 
-		// isp
-		for _, v := range a.ban.ISP {
-			if v == data[4] {
-				rw.WriteHeader(http.StatusForbidden)
-				return
+	if a.strictChain {
+		if a.headers.ChainCountries != "" {
+			countries := make([]string, len(hops))
+			for i, hop := range hops {
+				countries[i] = hop.data[0]
 			}
+			req.Header.Set(a.headers.ChainCountries, strings.Join(countries, ","))
 		}
 
-		// UserAgent
-		if a.ban.UserAgent.Enabled {
-			// Parse the User-Agent
-			agent := ua.Parse(req.UserAgent())
-
-			// Check Browser
-			for _, v := range a.ban.UserAgent.Browser {
-				if agent.Browser().String() == v {
-					rw.WriteHeader(http.StatusForbidden)
-					return
-				}
-			}
-
-			// Check browser version
-			for _, v := range a.ban.UserAgent.BrowserVersion {
-				if agent.BrowserVersion() == v {
+		if a.ban.Enabled {
+			for _, hop := range hops {
+				if !hop.skipGeo && a.ban.matchGeo(hop.data) {
 					rw.WriteHeader(http.StatusForbidden)
 					return
 				}
 			}
+		}
+	}
 
-			// Check Device
-			for _, v := range a.ban.UserAgent.Device {
-				if agent.Device().String() == v {
-					rw.WriteHeader(http.StatusForbidden)
-					return
-				}
-			}
+	if fields := a.chainMismatch.detect(hops); len(fields) > 0 {
+		if a.headers.ChainMismatch != "" {
+			req.Header.Set(a.headers.ChainMismatch, strings.Join(fields, ","))
+		}
+		if a.chainMismatch.action == mismatchBlock {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
 
+	// Ban
+	if a.ban.Enabled {
+		if !skipGeo && a.ban.matchGeo(data) {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if a.ban.matchUserAgent(req) {
+			rw.WriteHeader(http.StatusForbidden)
+			return
 		}
 	}
 
 	// Whitelist
 	if a.whitelist.Enabled {
-		// country
-		for _, v := range a.whitelist.Country {
-			if v == data[0] {
-				a.next.ServeHTTP(rw, req)
-				return
-			}
+		if skipGeo || a.whitelist.matchGeo(data) || a.whitelist.matchUserAgent(req) {
+			a.next.ServeHTTP(rw, req)
+			return
 		}
 
-		// province
-		for _, v := range a.whitelist.Province {
-			if v == data[2] {
-				a.next.ServeHTTP(rw, req)
-				return
-			}
+		// if the ip is not in the whitelist, return 403
+		rw.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	a.next.ServeHTTP(rw, req)
+}
+
+// matchGeo reports whether the country, province, city or isp of data is listed.
+// data is 国家|区域|省份|城市|ISP
+func (r *Rules) matchGeo(data []string) bool {
+	// country
+	for _, v := range r.Country {
+		if v == data[0] {
+			return true
 		}
+	}
 
-		// city
-		for _, v := range a.whitelist.City {
-			if v == data[3] {
-				a.next.ServeHTTP(rw, req)
-				return
-			}
+	// province
+	for _, v := range r.Province {
+		if v == data[2] {
+			return true
 		}
+	}
 
-		// isp
-		for _, v := range a.whitelist.ISP {
-			if v == data[4] {
-				a.next.ServeHTTP(rw, req)
-				return
-			}
+	// city
+	for _, v := range r.City {
+		if v == data[3] {
+			return true
 		}
+	}
 
-		// UserAgent
-		if a.whitelist.UserAgent.Enabled {
-			// Parse the User-Agent
-			agent := ua.Parse(req.UserAgent())
+	// isp
+	for _, v := range r.ISP {
+		if v == data[4] {
+			return true
+		}
+	}
+	return false
+}
 
-			// Check Browser
-			for _, v := range a.whitelist.UserAgent.Browser {
-				if agent.Browser().String() == v {
-					a.next.ServeHTTP(rw, req)
-					return
-				}
-			}
+// matchUserAgent reports whether the User-Agent of req is listed
+func (r *Rules) matchUserAgent(req *http.Request) bool {
+	if !r.UserAgent.Enabled {
+		return false
+	}
 
-			// Check browser version
-			for _, v := range a.whitelist.UserAgent.BrowserVersion {
-				if agent.BrowserVersion() == v {
-					a.next.ServeHTTP(rw, req)
-					return
-				}
-			}
+	// Parse the User-Agent
+	agent := ua.Parse(req.UserAgent())
 
-			// Check Device
-			for _, v := range a.whitelist.UserAgent.Device {
-				if agent.Device().String() == v {
-					a.next.ServeHTTP(rw, req)
-					return
-				}
-			}
+	// Check Browser
+	for _, v := range r.UserAgent.Browser {
+		if agent.Browser().String() == v {
+			return true
 		}
+	}
 
-		// if the ip is not in the whitelist, return 403
-		rw.WriteHeader(http.StatusForbidden)
-		return
+	// Check browser version
+	for _, v := range r.UserAgent.BrowserVersion {
+		if agent.BrowserVersion() == v {
+			return true
+		}
 	}
 
-	a.next.ServeHTTP(rw, req)
+	// Check Device
+	for _, v := range r.UserAgent.Device {
+		if agent.Device().String() == v {
+			return true
+		}
+	}
+	return false
 }
 
-func loadXdb(dbPath string) error {
-	if searcher == nil {
-		// 1、从 dbPath 加载整个 xdb 到内存
-		cBuff, err := xdb.LoadContentFromFile(dbPath)
-		if err != nil {
-			return fmt.Errorf("failed to load content from `%s`: %s", dbPath, err)
-		}
+// InvalidIPs returns how many requests carried a malformed client address
+func (a *TraefikIp2Region) InvalidIPs() uint64 {
+	return atomic.LoadUint64(&a.invalidIPs)
+}
 
-		// 2、用全局的 cBuff 创建完全基于内存的查询对象。
-		searcher, err = xdb.NewWithBuffer(cBuff)
-		if err != nil {
-			return fmt.Errorf("failed to create searcher with content: %s", err)
+// geoResult the lookup result of one address
+type geoResult struct {
+	// 国家|区域|省份|城市|ISP, empty strings when unknown
+	data []string
+	// reserved addresses that bypass the geo rules
+	skipGeo bool
+	// file reads of the lookup, 0 for a database cached in memory
+	ioCount int
+	// xdb, mmdb, text, overlay or reserved
+	source string
+	// the provider that answered each field of data, empty when unknown
+	fields []string
+}
+
+// lookup returns the geo data of ipStr, from the cache when it is enabled
+func (a *TraefikIp2Region) lookup(ipStr string) geoResult {
+	if a.cache == nil {
+		geo, _ := a.resolve(ipStr)
+		return geo
+	}
+
+	generation := a.generation()
+	if geo, ok := a.cache.get(ipStr, generation); ok {
+		// no file was read for a cached result
+		geo.ioCount = 0
+		return geo
+	}
+
+	geo, ok := a.resolve(ipStr)
+	if ok {
+		a.cache.put(ipStr, geo, generation)
+	}
+	return geo
+}
+
+// resolve looks up ipStr in the overlay, reserved ranges and databases,
+// false when the database failed and the result must not be cached
+func (a *TraefikIp2Region) resolve(ipStr string) (geoResult, bool) {
+	// local corrections win over everything else
+	if data, ok := a.overlay.lookup(ipStr); ok {
+		geo := geoResult{data: data, source: geoSourceOverlay}
+		a.fallback(&geo, ipStr)
+		return geo, true
+	}
+
+	var data []string = make([]string, 5)
+
+	if label, ok := a.reserved.classify(ipStr); ok {
+		// reserved and internal addresses are not looked up
+		data[0] = label
+		return geoResult{data: data, skipGeo: a.reserved.skipRules, source: geoSourceReserved}, true
+	}
+
+	// 国家|区域|省份|城市|ISP
+	source := geoSourceXdb
+	region, ioCount, err := "", 0, fmt.Errorf("no IPv6 database configured for `%s`", ipStr)
+	if db := a.dbFor(ipStr); db != nil {
+		source = db.format()
+		region, ioCount, err = db.search(ipStr)
+	}
+	if err == nil {
+		data = strings.Split(region, "|")
+		if len(data) < 5 {
+			// If the data is not enough, fill it with empty strings
+			data = make([]string, 5)
 		}
 	}
-	return nil
+	geo := geoResult{data: data, ioCount: ioCount, source: source}
+	a.fallback(&geo, ipStr)
+	return geo, err == nil
 }
 
-func getClientIP(req *http.Request, ipFromHeader string) string {
-	if ipFromHeader != "" {
-		// Check header first
-		forwardedFor := req.Header.Get(ipFromHeader)
-		if forwardedFor != "" {
-			ips := strings.Split(forwardedFor, ",")
-			return strings.TrimSpace(ips[0])
+// clientIP resolves the client address and the source it was taken from
+func (a *TraefikIp2Region) clientIP(req *http.Request) (string, string) {
+	switch {
+	case len(a.sources) > 0:
+		return resolveClientIP(req, a.sources, a.trusted)
+	case a.cdn != nil:
+		ip := a.cdn.clientIP(req)
+		if ip != remoteIP(req) {
+			return ip, a.cdn.name
 		}
+		return ip, sourceModeRemoteAddr
+	default:
+		ip := getClientIP(req, a.ipFromHeader, a.trusted)
+		if ip != remoteIP(req) {
+			return ip, a.ipFromHeader
+		}
+		return ip, sourceModeRemoteAddr
 	}
+}
 
-	// If ipFromHeader is not present or retrieval is not enabled, fallback to RemoteAddr
-	remoteAddr := req.RemoteAddr
-	tmp, _, err := net.SplitHostPort(remoteAddr)
-	if err == nil {
-		remoteAddr = tmp
+// dbFor picks the database matching the address family of ipStr, nil when none is configured
+func (a *TraefikIp2Region) dbFor(ipStr string) *dbEntry {
+	addr, err := netip.ParseAddr(ipStr)
+	if err == nil && addr.Is6() && !addr.Is4In6() {
+		// an IPv6 MaxMind or inline database serves IPv6 without dbPathV6
+		if a.db6 == nil && a.db.supports(ipv6VersionNo) {
+			return a.db
+		}
+		return a.db6
 	}
-	return remoteAddr
+	return a.db
+}
+
+// Degraded reports whether a configured database is not loaded
+func (a *TraefikIp2Region) Degraded() bool {
+	return !a.db.loaded() || (a.db6 != nil && !a.db6.loaded())
 }
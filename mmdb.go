@@ -0,0 +1,566 @@
+package traefik_ip2region
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+// mmdbMetadataMarker starts the metadata section at the end of a MaxMind DB file
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbMetadataMaxSize the metadata is searched for in this many trailing bytes
+const mmdbMetadataMaxSize = 128 * 1024
+
+// mmdbDataSectionSeparator the zero bytes between search tree and data section
+const mmdbDataSectionSeparator = 16
+
+// mmdb data field types
+const (
+	mmdbExtended  = 0
+	mmdbPointer   = 1
+	mmdbString    = 2
+	mmdbDouble    = 3
+	mmdbBytes     = 4
+	mmdbUint16    = 5
+	mmdbUint32    = 6
+	mmdbMap       = 7
+	mmdbInt32     = 8
+	mmdbUint64    = 9
+	mmdbUint128   = 10
+	mmdbSlice     = 11
+	mmdbContainer = 12
+	mmdbEndMarker = 13
+	mmdbBool      = 14
+	mmdbFloat     = 15
+)
+
+// Mmdb part of the configuration, how MaxMind DB records map onto the headers
+type Mmdb struct {
+	// Language of the names, en by default
+	Language string `yaml:"language,omitempty"`
+	// CountryISOCode puts the ISO 3166-1 code into the country field instead of the name
+	CountryISOCode bool `yaml:"countryIsoCode,omitempty"`
+}
+
+// mmdbMetadata the fields of the metadata section the reader relies on
+type mmdbMetadata struct {
+	NodeCount    uint32
+	RecordSize   int
+	IPVersion    int
+	DatabaseType string
+	MajorVersion int
+	BuildEpoch   uint64
+}
+
+// mmdbReader a MaxMind DB file held in memory, safe for concurrent use
+type mmdbReader struct {
+	buffer     []byte
+	metadata   mmdbMetadata
+	nodeSize   int
+	dataStart  int
+	ipv4Start  uint32
+	ipv4Depth  int
+	treeLength int
+}
+
+// newMmdbReader parses the metadata and validates the layout of buffer
+func newMmdbReader(buffer []byte) (*mmdbReader, error) {
+	start := len(buffer) - mmdbMetadataMaxSize
+	if start < 0 {
+		start = 0
+	}
+	idx := bytes.LastIndex(buffer[start:], mmdbMetadataMarker)
+	if idx < 0 {
+		return nil, fmt.Errorf("no MaxMind DB metadata found")
+	}
+	metaStart := start + idx + len(mmdbMetadataMarker)
+
+	d := mmdbDecoder{buffer: buffer[metaStart:]}
+	raw, _, err := d.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %s", err)
+	}
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid metadata: not a map")
+	}
+
+	metadata := mmdbMetadata{
+		NodeCount:    uint32(toUint64(m["node_count"])),
+		RecordSize:   int(toUint64(m["record_size"])),
+		IPVersion:    int(toUint64(m["ip_version"])),
+		MajorVersion: int(toUint64(m["binary_format_major_version"])),
+		BuildEpoch:   toUint64(m["build_epoch"]),
+	}
+	metadata.DatabaseType, _ = m["database_type"].(string)
+
+	if metadata.MajorVersion != 2 {
+		return nil, fmt.Errorf("unsupported binary format version %d", metadata.MajorVersion)
+	}
+	if metadata.RecordSize != 24 && metadata.RecordSize != 28 && metadata.RecordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", metadata.RecordSize)
+	}
+	if metadata.IPVersion != ipv4VersionNo && metadata.IPVersion != ipv6VersionNo {
+		return nil, fmt.Errorf("unsupported ip version %d", metadata.IPVersion)
+	}
+
+	r := &mmdbReader{buffer: buffer, metadata: metadata, nodeSize: metadata.RecordSize / 4}
+	r.treeLength = int(metadata.NodeCount) * r.nodeSize
+	r.dataStart = r.treeLength + mmdbDataSectionSeparator
+	if r.dataStart > start+idx {
+		return nil, fmt.Errorf("search tree of %d nodes exceeds the file", metadata.NodeCount)
+	}
+
+	// IPv4 addresses live below ::/96 of an IPv6 tree
+	if metadata.IPVersion == ipv6VersionNo {
+		node := uint32(0)
+		i := 0
+		for ; i < 96 && node < metadata.NodeCount; i++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start, r.ipv4Depth = node, i
+	}
+	return r, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node
+func (r *mmdbReader) record(node uint32, bit int) uint32 {
+	b := r.buffer[int(node)*r.nodeSize:]
+	switch r.metadata.RecordSize {
+	case 24:
+		if bit == 0 {
+			return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+		}
+		return uint32(b[3])<<16 | uint32(b[4])<<8 | uint32(b[5])
+	case 28:
+		if bit == 0 {
+			return (uint32(b[3])&0xF0)<<20 | uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+		}
+		return (uint32(b[3])&0x0F)<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+	default:
+		if bit == 0 {
+			return binary.BigEndian.Uint32(b)
+		}
+		return binary.BigEndian.Uint32(b[4:])
+	}
+}
+
+// lookup returns the record of addr, nil when the address is not in the database
+func (r *mmdbReader) lookup(addr netip.Addr) (map[string]interface{}, error) {
+	addr = addr.Unmap()
+
+	var ip []byte
+	node, depth := uint32(0), 0
+	if addr.Is4() {
+		b := addr.As4()
+		ip = b[:]
+		if r.metadata.IPVersion == ipv6VersionNo {
+			node, depth = r.ipv4Start, 0
+			if r.ipv4Depth < 96 {
+				// the tree ends above ::/96, no IPv4 data
+				return r.resolve(node)
+			}
+		}
+	} else {
+		if r.metadata.IPVersion == ipv4VersionNo {
+			return nil, fmt.Errorf("IPv6 address in an IPv4 database")
+		}
+		b := addr.As16()
+		ip = b[:]
+	}
+
+	bitCount := len(ip) * 8
+	for ; depth < bitCount && node < r.metadata.NodeCount; depth++ {
+		bit := int(ip[depth>>3]>>(7-uint(depth&7))) & 1
+		node = r.record(node, bit)
+	}
+	return r.resolve(node)
+}
+
+// records calls fn with every distinct record of the search tree
+func (r *mmdbReader) records(fn func(record map[string]interface{})) error {
+	// IPv6 trees alias the IPv4 subtree, every node is visited once
+	visited := make([]bool, r.metadata.NodeCount)
+	seen := map[uint32]bool{}
+	stack := []uint32{0}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if visited[node] {
+			continue
+		}
+		visited[node] = true
+
+		for bit := 0; bit < 2; bit++ {
+			child := r.record(node, bit)
+			switch {
+			case child < r.metadata.NodeCount:
+				stack = append(stack, child)
+			case child > r.metadata.NodeCount && !seen[child]:
+				seen[child] = true
+				record, err := r.resolve(child)
+				if err != nil {
+					return err
+				}
+				fn(record)
+			}
+		}
+	}
+	return nil
+}
+
+// resolve decodes the data a terminal record points to
+func (r *mmdbReader) resolve(node uint32) (map[string]interface{}, error) {
+	if node == r.metadata.NodeCount {
+		return nil, nil
+	}
+	if node < r.metadata.NodeCount {
+		return nil, fmt.Errorf("search tree ended inside the tree")
+	}
+
+	offset := int(node-r.metadata.NodeCount) - mmdbDataSectionSeparator
+	d := mmdbDecoder{buffer: r.buffer[r.dataStart:]}
+	value, _, err := d.decode(offset, 0)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("record at %d is not a map", offset)
+	}
+	return m, nil
+}
+
+// mmdbDecoder decodes the data section format, pointers are relative to buffer
+type mmdbDecoder struct {
+	buffer []byte
+}
+
+// mmdbMaxDepth guards against pointer loops and deeply nested data
+const mmdbMaxDepth = 32
+
+// decode returns the value at offset and the offset after it
+func (d *mmdbDecoder) decode(offset, depth int) (interface{}, int, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, fmt.Errorf("data nested too deep")
+	}
+	if offset < 0 || offset >= len(d.buffer) {
+		return nil, 0, fmt.Errorf("offset %d out of range", offset)
+	}
+
+	ctrl := d.buffer[offset]
+	offset++
+	typeNum := int(ctrl >> 5)
+
+	if typeNum == mmdbPointer {
+		pointer, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(pointer, depth+1)
+		return value, next, err
+	}
+
+	if typeNum == mmdbExtended {
+		if offset >= len(d.buffer) {
+			return nil, 0, fmt.Errorf("offset %d out of range", offset)
+		}
+		typeNum = 7 + int(d.buffer[offset])
+		offset++
+	}
+
+	size, offset, err := d.size(ctrl, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch typeNum {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			key, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key at %d is not a string", offset)
+			}
+			value, next, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[k] = value
+			offset = next
+		}
+		return m, offset, nil
+	case mmdbSlice:
+		s := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			value, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			s = append(s, value)
+			offset = next
+		}
+		return s, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > len(d.buffer) {
+		return nil, 0, fmt.Errorf("value at %d exceeds the data section", offset)
+	}
+	raw := d.buffer[offset : offset+size]
+	next := offset + size
+
+	switch typeNum {
+	case mmdbString:
+		return string(raw), next, nil
+	case mmdbBytes, mmdbUint128:
+		return append([]byte(nil), raw...), next, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), next, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), next, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("invalid integer size %d", size)
+		}
+		var v uint64
+		for _, b := range raw {
+			v = v<<8 | uint64(b)
+		}
+		return v, next, nil
+	case mmdbInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("invalid integer size %d", size)
+		}
+		var v uint32
+		for _, b := range raw {
+			v = v<<8 | uint32(b)
+		}
+		return int64(int32(v)), next, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported data type %d", typeNum)
+	}
+}
+
+// size decodes the payload size of a control byte
+func (d *mmdbDecoder) size(ctrl byte, offset int) (int, int, error) {
+	size := int(ctrl & 0x1f)
+	if size < 29 {
+		return size, offset, nil
+	}
+
+	n := size - 28
+	if offset+n > len(d.buffer) {
+		return 0, 0, fmt.Errorf("size at %d exceeds the data section", offset)
+	}
+	var v int
+	for _, b := range d.buffer[offset : offset+n] {
+		v = v<<8 | int(b)
+	}
+
+	switch size {
+	case 29:
+		return 29 + v, offset + n, nil
+	case 30:
+		return 285 + v, offset + n, nil
+	default:
+		return 65821 + v, offset + n, nil
+	}
+}
+
+// pointer decodes a pointer and returns its target and the offset after it
+func (d *mmdbDecoder) pointer(ctrl byte, offset int) (int, int, error) {
+	n := int((ctrl>>3)&0x3) + 1
+	if offset+n > len(d.buffer) {
+		return 0, 0, fmt.Errorf("pointer at %d exceeds the data section", offset)
+	}
+
+	var v int
+	if n < 4 {
+		v = int(ctrl & 0x7)
+	}
+	for _, b := range d.buffer[offset : offset+n] {
+		v = v<<8 | int(b)
+	}
+
+	switch n {
+	case 2:
+		v += 2048
+	case 3:
+		v += 526336
+	}
+	return v, offset + n, nil
+}
+
+// toUint64 converts a decoded integer, 0 for anything else
+func toUint64(v interface{}) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case int64:
+		if n >= 0 {
+			return uint64(n)
+		}
+	}
+	return 0
+}
+
+// mmdbSearcher maps MaxMind DB records onto 国家|区域|省份|城市|ISP
+type mmdbSearcher struct {
+	reader   *mmdbReader
+	language string
+	isoCode  bool
+}
+
+func loadMmdb(dbPath string, opts Mmdb) (*mmdbSearcher, *dbMeta, error) {
+	buffer, err := os.ReadFile(dbPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load content from `%s`: %s", dbPath, err)
+	}
+
+	reader, err := newMmdbReader(buffer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid mmdb file `%s`: %s", dbPath, err)
+	}
+
+	language := opts.Language
+	if language == "" {
+		language = "en"
+	}
+
+	meta := &dbMeta{
+		Format:    dbFormatMmdb,
+		Version:   reader.metadata.MajorVersion,
+		IPVersion: reader.metadata.IPVersion,
+		Type:      reader.metadata.DatabaseType,
+		CreatedAt: time.Unix(int64(reader.metadata.BuildEpoch), 0).UTC(),
+	}
+	return &mmdbSearcher{reader: reader, language: language, isoCode: opts.CountryISOCode}, meta, nil
+}
+
+// Close nothing to release for a buffer based searcher
+func (s *mmdbSearcher) Close() {}
+
+func (s *mmdbSearcher) search(ip string) (string, int, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid ip address `%s`", ip)
+	}
+
+	record, err := s.reader.lookup(addr)
+	if err != nil || record == nil {
+		return "", 0, err
+	}
+	return s.region(record), 0, nil
+}
+
+// region maps a record onto 国家|区域|省份|城市|ISP
+func (s *mmdbSearcher) region(record map[string]interface{}) string {
+	country := s.name(record, "country")
+	if s.isoCode {
+		country = stringAt(record, "country", "iso_code")
+	}
+
+	province := ""
+	if subdivisions, ok := record["subdivisions"].([]interface{}); ok && len(subdivisions) > 0 {
+		if first, ok := subdivisions[0].(map[string]interface{}); ok {
+			province = s.name(first, "")
+		}
+	}
+
+	// GeoIP2-ISP and GeoLite2-ASN store the ISP at the top level
+	isp := stringAt(record, "isp")
+	if isp == "" {
+		isp = stringAt(record, "organization")
+	}
+	if isp == "" {
+		isp = stringAt(record, "autonomous_system_organization")
+	}
+	if isp == "" {
+		isp = stringAt(record, "traits", "isp")
+	}
+
+	fields := []string{country, "0", province, s.name(record, "city"), isp}
+	for i, f := range fields {
+		if f == "" || strings.Contains(f, "|") {
+			fields[i] = "0"
+		}
+	}
+	return strings.Join(fields, "|")
+}
+
+func (s *mmdbSearcher) regions(fn func(region string)) error {
+	return s.reader.records(func(record map[string]interface{}) {
+		fn(s.region(record))
+	})
+}
+
+// name returns names[language] of record[key], or of record itself when key is empty
+func (s *mmdbSearcher) name(record map[string]interface{}, key string) string {
+	if key != "" {
+		var ok bool
+		if record, ok = record[key].(map[string]interface{}); !ok {
+			return ""
+		}
+	}
+	if v := stringAt(record, "names", s.language); v != "" {
+		return v
+	}
+	return stringAt(record, "names", "en")
+}
+
+// stringAt follows keys through nested maps and returns the string at the end
+func stringAt(record map[string]interface{}, keys ...string) string {
+	var value interface{} = record
+	for _, k := range keys {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = m[k]
+	}
+	s, _ := value.(string)
+	return s
+}
+
+// isMmdb reports whether the file at path ends with MaxMind DB metadata
+func isMmdb(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	size := fi.Size()
+	start := size - mmdbMetadataMaxSize
+	if start < 0 {
+		start = 0
+	}
+	buff := make([]byte, size-start)
+	if _, err := f.ReadAt(buff, start); err != nil {
+		return false
+	}
+	return bytes.Contains(buff, mmdbMetadataMarker)
+}
@@ -0,0 +1,288 @@
+package traefik_ip2region
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testMmdbRecord one network of a test MaxMind database
+type testMmdbRecord struct {
+	prefix string
+	data   map[string]interface{}
+}
+
+func testMmdbCity(iso, country, province, city string) map[string]interface{} {
+	record := map[string]interface{}{
+		"country": map[string]interface{}{
+			"iso_code": iso,
+			"names":    map[string]interface{}{"en": country},
+		},
+	}
+	if province != "" {
+		record["subdivisions"] = []interface{}{
+			map[string]interface{}{"names": map[string]interface{}{"en": province}},
+		}
+	}
+	if city != "" {
+		record["city"] = map[string]interface{}{"names": map[string]interface{}{"en": city, "de": city + "-de"}}
+	}
+	return record
+}
+
+var testMmdbRecords = []testMmdbRecord{
+	{"1.1.1.0/24", testMmdbCity("AU", "Australia", "Queensland", "Brisbane")},
+	{"8.8.8.0/24", func() map[string]interface{} {
+		r := testMmdbCity("US", "United States", "", "")
+		r["autonomous_system_organization"] = "Google LLC"
+		return r
+	}()},
+	{"2001:db8::/32", testMmdbCity("DE", "Germany", "Hesse", "Frankfurt am Main")},
+}
+
+// writeTestMmdb writes an IPv6 MaxMind DB with 24 bit records, IPv4 lives below ::/96
+func writeTestMmdb(t *testing.T, records []testMmdbRecord) string {
+	t.Helper()
+
+	type node struct {
+		children [2]*node
+		data     int
+	}
+	newNode := func() *node { return &node{data: -1} }
+	root := newNode()
+
+	var data bytes.Buffer
+	for _, r := range records {
+		prefix := netip.MustParsePrefix(r.prefix)
+		ip, bits := prefix.Addr().As16(), prefix.Bits()
+		if prefix.Addr().Is4() {
+			var mapped [16]byte
+			copy(mapped[12:], prefix.Addr().AsSlice())
+			ip, bits = mapped, bits+96
+		}
+
+		offset := data.Len()
+		encodeTestMmdb(&data, r.data)
+
+		n := root
+		for i := 0; i < bits; i++ {
+			bit := ip[i>>3] >> (7 - uint(i&7)) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = newNode()
+			}
+			n = n.children[bit]
+		}
+		n.data = offset
+	}
+
+	// number the inner nodes breadth first
+	var nodes []*node
+	index := map[*node]int{}
+	queue := []*node{root}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if n.data >= 0 {
+			continue
+		}
+		index[n] = len(nodes)
+		nodes = append(nodes, n)
+		for _, c := range n.children {
+			if c != nil {
+				queue = append(queue, c)
+			}
+		}
+	}
+
+	count := len(nodes)
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		for _, c := range n.children {
+			v := count
+			switch {
+			case c == nil:
+			case c.data >= 0:
+				v = count + 16 + c.data
+			default:
+				v = index[c]
+			}
+			buf.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+	}
+	buf.Write(make([]byte, 16))
+	buf.Write(data.Bytes())
+	buf.Write(mmdbMetadataMarker)
+	encodeTestMmdb(&buf, map[string]interface{}{
+		"node_count":                  uint32(count),
+		"record_size":                 uint16(24),
+		"ip_version":                  uint16(6),
+		"database_type":               "GeoLite2-City",
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1700000000),
+		"languages":                   []interface{}{"en"},
+	})
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// encodeTestMmdb writes v in the data section format, sizes stay below 285
+func encodeTestMmdb(buf *bytes.Buffer, v interface{}) {
+	ctrl := func(typeNum, size int) {
+		sizeBits, extra := size, []byte(nil)
+		if size >= 29 {
+			sizeBits, extra = 29, []byte{byte(size - 29)}
+		}
+		if typeNum > 7 {
+			buf.Write([]byte{byte(sizeBits), byte(typeNum - 7)})
+		} else {
+			buf.WriteByte(byte(typeNum<<5 | sizeBits))
+		}
+		buf.Write(extra)
+	}
+	uint := func(typeNum int, n uint64, size int) {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, n)
+		ctrl(typeNum, size)
+		buf.Write(b[8-size:])
+	}
+
+	switch x := v.(type) {
+	case string:
+		ctrl(mmdbString, len(x))
+		buf.WriteString(x)
+	case uint16:
+		uint(mmdbUint16, uint64(x), 2)
+	case uint32:
+		uint(mmdbUint32, uint64(x), 4)
+	case uint64:
+		uint(mmdbUint64, x, 8)
+	case []interface{}:
+		ctrl(mmdbSlice, len(x))
+		for _, e := range x {
+			encodeTestMmdb(buf, e)
+		}
+	case map[string]interface{}:
+		ctrl(mmdbMap, len(x))
+		for k, e := range x {
+			encodeTestMmdb(buf, k)
+			encodeTestMmdb(buf, e)
+		}
+	}
+}
+
+func TestMmdbSearch(t *testing.T) {
+	path := writeTestMmdb(t, testMmdbRecords)
+
+	searcher, meta, err := loadDatabase(path, dbOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Format != dbFormatMmdb || meta.Type != "GeoLite2-City" || !meta.supports(ipv4VersionNo) {
+		t.Errorf("invalid metadata: %+v", meta)
+	}
+
+	tests := map[string]string{
+		"1.1.1.1":     "Australia|0|Queensland|Brisbane|0",
+		"8.8.8.8":     "United States|0|0|0|Google LLC",
+		"2001:db8::1": "Germany|0|Hesse|Frankfurt am Main|0",
+		"9.9.9.9":     "",
+	}
+	for ip, expected := range tests {
+		region, _, err := searcher.search(ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if region != expected {
+			t.Errorf("%s: got %q, want %q", ip, region, expected)
+		}
+	}
+
+	searcher, _, err = loadDatabase(path, dbOptions{provider: providerMmdb, mmdb: Mmdb{Language: "de", CountryISOCode: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if region, _, _ := searcher.search("2001:db8::1"); region != "DE|0|Hesse|Frankfurt am Main-de|0" {
+		t.Errorf("invalid localized region: %q", region)
+	}
+}
+
+func TestMmdbDecodePointer(t *testing.T) {
+	d := mmdbDecoder{buffer: []byte{0x42, 'h', 'i', 0x20, 0x00}}
+	v, next, err := d.decode(3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "hi" || next != 5 {
+		t.Errorf("got %v at %d", v, next)
+	}
+}
+
+func TestMmdbMiddleware(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DBPath = writeTestMmdb(t, testMmdbRecords)
+	cfg.Provider = providerMmdb
+	cfg.Headers.Country = "X-Ip2region-Country"
+	cfg.Headers.City = "X-Ip2region-City"
+	cfg.Headers.GeoSource = "X-Ip2region-Source"
+	cfg.Headers.GeoFields = "X-Ip2region-Fields"
+	cfg.Ban = Rules{Enabled: true, Country: []string{"United States"}}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := New(context.Background(), next, cfg, "demo-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.(*TraefikIp2Region).Close()
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "[2001:db8::1]:4711"
+	handler.ServeHTTP(recorder, req)
+	assertHeader(t, req, "X-Ip2region-Country", "Germany")
+	assertHeader(t, req, "X-Ip2region-City", "Frankfurt am Main")
+	assertHeader(t, req, "X-Ip2region-Source", dbFormatMmdb)
+	assertHeader(t, req, "X-Ip2region-Fields", "country=mmdb; province=mmdb; city=mmdb")
+
+	recorder = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "8.8.8.8:4711"
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("banned country got %d", recorder.Code)
+	}
+}
+
+func TestMmdbCachePolicy(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DBPath = writeTestMmdb(t, testMmdbRecords)
+	cfg.Provider = providerMmdb
+	cfg.CachePolicy = cachePolicyFile
+
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "demo-plugin"); err == nil {
+		t.Error("file cache policy accepted for mmdb")
+	}
+
+	// unknown policies are rejected for every provider, even with failOpen
+	for _, provider := range []string{"", providerXdb, providerMmdb} {
+		cfg := CreateConfig()
+		cfg.DBPath = writeTestXdb(t, testRanges)
+		cfg.Provider = provider
+		cfg.CachePolicy = "memory"
+		cfg.OnDBError = onDBErrorFailOpen
+
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "demo-plugin"); err == nil {
+			t.Errorf("unknown cache policy accepted for provider `%s`", provider)
+		}
+	}
+}
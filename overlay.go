@@ -0,0 +1,259 @@
+package traefik_ip2region
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// geo sources reported in the geoSource header, besides the database formats
+const (
+	geoSourceXdb      = "xdb"
+	geoSourceOverlay  = "overlay"
+	geoSourceReserved = "reserved"
+)
+
+// overlay local CIDR corrections checked before the database.
+// The file is CSV: cidr,country,region,province,city,isp
+type overlay struct {
+	path   string
+	key    string
+	refs   int
+	stopCh chan struct{}
+
+	mu sync.RWMutex
+	// prefix lengths present in entries, longest first
+	bits    []int
+	entries map[netip.Prefix][]string
+	modTime time.Time
+	size    int64
+	// incremented with every load
+	version int
+}
+
+// newOverlay loads path, nil when no overlay is configured
+func newOverlay(path string) (*overlay, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	o := &overlay{path: path}
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// overlays shares one overlay and its watcher per file across instances, like the databases
+var overlays = &overlayRegistry{entries: map[string]*overlay{}}
+
+// overlayRegistry keeps one overlay per file by reference count
+type overlayRegistry struct {
+	mu      sync.Mutex
+	entries map[string]*overlay
+}
+
+// acquire returns the overlay for path, loading it on first use, nil when no overlay is configured.
+// A positive reloadInterval starts watching the file for changes.
+func (r *overlayRegistry) acquire(path string, reloadInterval time.Duration) (*overlay, error) {
+	if path == "" {
+		return nil, nil
+	}
+	key := dbKey(path)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	o, ok := r.entries[key]
+	if !ok {
+		var err error
+		if o, err = newOverlay(path); err != nil {
+			return nil, err
+		}
+		o.key = key
+		r.entries[key] = o
+	}
+
+	o.refs++
+	if reloadInterval > 0 && o.stopCh == nil {
+		o.stopCh = make(chan struct{})
+		go watchFile(o.path, reloadInterval, o.stopCh, o.stamp, o.load)
+	}
+	return o, nil
+}
+
+// release drops one reference, the watcher stops with the last one
+func (r *overlayRegistry) release(o *overlay) {
+	if o == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	o.refs--
+	if o.refs > 0 {
+		return
+	}
+	if r.entries[o.key] == o {
+		delete(r.entries, o.key)
+	}
+	if o.stopCh != nil {
+		close(o.stopCh)
+		o.stopCh = nil
+	}
+}
+
+// lookup returns 国家|区域|省份|城市|ISP of the longest matching prefix
+func (o *overlay) lookup(ipStr string) ([]string, bool) {
+	if o == nil {
+		return nil, false
+	}
+
+	addr, err := netip.ParseAddr(ipStr)
+	if err != nil {
+		return nil, false
+	}
+	addr = addr.Unmap()
+
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	for _, bits := range o.bits {
+		if bits > addr.BitLen() {
+			continue
+		}
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if data, ok := o.entries[prefix]; ok {
+			return append([]string(nil), data...), true
+		}
+	}
+	return nil, false
+}
+
+// load parses the file and swaps it in, the current entries stay on failure
+func (o *overlay) load() error {
+	f, err := os.Open(o.path)
+	if err != nil {
+		return fmt.Errorf("failed to open overlay `%s`: %s", o.path, err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat overlay `%s`: %s", o.path, err)
+	}
+
+	entries, err := parseOverlay(f)
+	if err != nil {
+		return fmt.Errorf("invalid overlay `%s`: %s", o.path, err)
+	}
+
+	seen := map[int]bool{}
+	var bits []int
+	for prefix := range entries {
+		if !seen[prefix.Bits()] {
+			seen[prefix.Bits()] = true
+			bits = append(bits, prefix.Bits())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(bits)))
+
+	o.mu.Lock()
+	o.entries, o.bits = entries, bits
+	o.modTime, o.size = fi.ModTime(), fi.Size()
+	o.version++
+	o.mu.Unlock()
+	return nil
+}
+
+// parseOverlay reads cidr,country,region,province,city,isp records.
+// Empty lines and lines starting with # are skipped, missing fields become 0.
+func parseOverlay(r io.Reader) (map[netip.Prefix][]string, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	entries := map[netip.Prefix][]string{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) > 6 {
+			return nil, fmt.Errorf("too many fields in `%s`", strings.Join(record, ","))
+		}
+
+		prefix, err := parsePrefix(strings.TrimSpace(record[0]))
+		if err != nil {
+			return nil, err
+		}
+
+		data := []string{"0", "0", "0", "0", "0"}
+		for i, v := range record[1:] {
+			if v = strings.TrimSpace(v); v != "" {
+				data[i] = v
+			}
+		}
+		entries[prefix] = data
+	}
+	return entries, nil
+}
+
+// parsePrefix accepts a CIDR or a single address
+func parsePrefix(v string) (netip.Prefix, error) {
+	if strings.Contains(v, "/") {
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid cidr `%s`", v)
+		}
+		if prefix.Addr().Is4In6() {
+			if prefix.Bits() < 96 {
+				// wider than the mapped range
+				return netip.Prefix{}, fmt.Errorf("invalid cidr `%s`", v)
+			}
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(v)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid cidr `%s`", v)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// generation the number of loads, 0 without an overlay
+func (o *overlay) generation() int {
+	if o == nil {
+		return 0
+	}
+
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	return o.version
+}
+
+// stamp returns the mtime and size of the loaded file
+func (o *overlay) stamp() (time.Time, int64) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	return o.modTime, o.size
+}
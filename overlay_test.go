@@ -0,0 +1,133 @@
+package traefik_ip2region
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOverlayLongestPrefix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overlay.csv")
+	content := `# office and partner ranges
+223.5.0.0/16,中国,0,浙江省,杭州市,Partner VPN
+223.5.5.0/24,中国,0,浙江省,杭州市,Office
+2001:db8::/32,日本
+`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := newOverlay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"223.5.5.5":        "中国|0|浙江省|杭州市|Office",
+		"223.5.6.1":        "中国|0|浙江省|杭州市|Partner VPN",
+		"::ffff:223.5.5.5": "中国|0|浙江省|杭州市|Office",
+		"2001:db8::1":      "日本|0|0|0|0",
+		"1.1.1.1":          "",
+	}
+	for ip, expected := range tests {
+		data, _ := o.lookup(ip)
+		if got := strings.Join(data, "|"); got != expected {
+			t.Errorf("lookup(%s) = %s, want %s", ip, got, expected)
+		}
+	}
+
+	for _, line := range []string{"not-a-cidr,中国\n", "::ffff:0.0.0.0/64,中国\n"} {
+		if _, err := parseOverlay(strings.NewReader(line)); err == nil {
+			t.Errorf("expected an error for the invalid cidr %q", line)
+		}
+	}
+}
+
+func TestOverlayServeHTTP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overlay.csv")
+	if err := os.WriteFile(path, []byte("1.1.1.0/24,新西兰,0,0,0,0\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := CreateConfig()
+	cfg.DBPath = writeTestXdb(t, testRanges)
+	cfg.OverlayPath = path
+	cfg.ReloadInterval = "10ms"
+	cfg.Headers.GeoSource = "X-Ip2region-Source"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := New(context.Background(), next, cfg, "demo-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.(*TraefikIp2Region).Close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "1.1.1.1:9999"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, "X-Ip2region-Country", "新西兰")
+	assertHeader(t, req, "X-Ip2region-Source", geoSourceOverlay)
+
+	// removing the entry at runtime falls back to the database
+	if err := os.WriteFile(path, []byte("# empty\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = "1.1.1.1:9999"
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if req.Header.Get("X-Ip2region-Source") == geoSourceXdb {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("overlay was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertHeader(t, req, "X-Ip2region-Country", "澳大利亚")
+}
+
+func TestOverlayShared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overlay.csv")
+	if err := os.WriteFile(path, []byte("1.1.1.0/24,新西兰\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := CreateConfig()
+	cfg.DBPath = writeTestXdb(t, testRanges)
+	cfg.OverlayPath = path
+	cfg.ReloadInterval = "1h"
+
+	// every rebuild of the configuration creates new instances
+	var plugins []*TraefikIp2Region
+	for i := 0; i < 3; i++ {
+		handler, err := New(context.Background(), http.NotFoundHandler(), cfg, "demo-plugin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		plugins = append(plugins, handler.(*TraefikIp2Region))
+	}
+	o := plugins[0].overlay
+	if plugins[1].overlay != o || plugins[2].overlay != o || o.refs != 3 {
+		t.Fatal("overlay not shared across instances")
+	}
+
+	stopCh := o.stopCh
+	for _, p := range plugins {
+		p.Close()
+	}
+	if _, ok := overlays.entries[o.key]; ok {
+		t.Error("overlay not released after the last instance")
+	}
+	select {
+	case <-stopCh:
+	default:
+		t.Error("overlay watcher not stopped")
+	}
+}
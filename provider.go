@@ -0,0 +1,145 @@
+package traefik_ip2region
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// geo providers, the database formats DBPath can hold
+const (
+	providerXdb  = "xdb"
+	providerMmdb = "mmdb"
+	providerText = "text"
+)
+
+// database formats reported in the metadata
+const (
+	dbFormatXdb  = "xdb"
+	dbFormatMmdb = "mmdb"
+	dbFormatText = "text"
+)
+
+// dbMeta describes a loaded database independent of its format
+type dbMeta struct {
+	Format string
+	// xdb structure or mmdb binary format version, 0 for text
+	Version int
+	// 4 or 6, the address family of the file
+	IPVersion int
+	// xdb only
+	IndexPolicy string
+	// mmdb only, e.g. GeoLite2-City
+	Type      string
+	CreatedAt time.Time
+}
+
+// meta converts an xdb header into the common metadata
+func (h *xdbHeader) meta() *dbMeta {
+	return &dbMeta{
+		Format:      dbFormatXdb,
+		Version:     int(h.Version),
+		IPVersion:   h.IPVersion,
+		IndexPolicy: h.IndexPolicy.String(),
+		CreatedAt:   h.createdAt(),
+	}
+}
+
+// supports reports whether addresses of ipVersion can be looked up.
+// IPv6 MaxMind databases also hold the IPv4 space.
+func (m *dbMeta) supports(ipVersion int) bool {
+	return m.IPVersion == ipVersion || (m.Format == dbFormatMmdb && m.IPVersion == ipv6VersionNo)
+}
+
+// validateProvider checks the configured provider and its cache policy
+func validateProvider(provider, cachePolicy string) error {
+	switch cachePolicy {
+	case "", cachePolicyContent, cachePolicyVectorIndex, cachePolicyFile:
+	default:
+		return fmt.Errorf("unknown cachePolicy `%s`", cachePolicy)
+	}
+
+	switch provider {
+	case "", providerXdb:
+		return nil
+	case providerMmdb, providerText:
+		if cachePolicy != "" && cachePolicy != cachePolicyContent {
+			return fmt.Errorf("cachePolicy `%s` is not supported by the %s provider", cachePolicy, provider)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown provider `%s`", provider)
+	}
+}
+
+// loadDatabase loads dbPath with the configured provider.
+// An empty provider detects MaxMind files by their metadata and ip2region source data
+// by its first line, anything else is treated as xdb.
+func loadDatabase(dbPath string, opts dbOptions) (ipSearcher, *dbMeta, error) {
+	provider := opts.provider
+	if provider == "" {
+		switch {
+		case isMmdb(dbPath):
+			provider = providerMmdb
+		case isTextFile(dbPath):
+			provider = providerText
+		default:
+			provider = providerXdb
+		}
+	}
+
+	// a detected format is checked here, a configured one already in New
+	if err := validateProvider(provider, opts.cachePolicy); err != nil {
+		return nil, nil, err
+	}
+	switch provider {
+	case providerMmdb:
+		return loadMmdb(dbPath, opts.mmdb)
+	case providerText:
+		return loadText(dbPath)
+	}
+
+	searcher, header, err := loadXdb(dbPath, opts.cachePolicy, opts.poolSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return searcher, header.meta(), nil
+}
+
+// validateDatabase checks a downloaded file before it replaces the current one
+func validateDatabase(content []byte) error {
+	if bytes.Contains(tail(content, mmdbMetadataMaxSize), mmdbMetadataMarker) {
+		_, err := newMmdbReader(content)
+		return err
+	}
+	if isTextSource(content) {
+		_, err := parseTextSource(bytes.NewReader(content))
+		return err
+	}
+	_, err := validateXdb(content, int64(len(content)))
+	return err
+}
+
+// tail returns the last n bytes of b
+func tail(b []byte, n int) []byte {
+	if len(b) > n {
+		return b[len(b)-n:]
+	}
+	return b
+}
+
+// String describes the database for the load log
+func (m *dbMeta) String() string {
+	s := m.Format
+	if m.Version > 0 {
+		s += fmt.Sprintf(" structure %d", m.Version)
+	}
+	s += fmt.Sprintf(", IPv%d", m.IPVersion)
+	if m.IndexPolicy != "" {
+		s += ", " + m.IndexPolicy
+	}
+	if m.Type != "" {
+		s += ", " + m.Type
+	}
+	return s + ", created at " + m.CreatedAt.Format(time.RFC3339)
+}
@@ -0,0 +1,107 @@
+package traefik_ip2region
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// Reserved part of the configuration
+type Reserved struct {
+	Enabled bool `yaml:"enabled"`
+	// Networks custom internal networks, checked before the built-in ranges
+	Networks []InternalNetwork `yaml:"networks"`
+	// SkipRules lets reserved clients pass the geo rules of ban and whitelist
+	SkipRules bool `yaml:"skipRules"`
+}
+
+// InternalNetwork a custom internal network and its label, e.g. an office name
+type InternalNetwork struct {
+	CIDR  string `yaml:"cidr"`
+	Label string `yaml:"label"`
+}
+
+// labelled a network and the value it puts into the country header
+type labelled struct {
+	prefix netip.Prefix
+	label  string
+}
+
+// reservedRanges special purpose ranges of RFC 6890 and its successors
+var reservedRanges = mustLabelled(map[string][]string{
+	"unspecified":   {"0.0.0.0/8", "::/128"},
+	"loopback":      {"127.0.0.0/8", "::1/128"},
+	"private":       {"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"},
+	"cgnat":         {"100.64.0.0/10"},
+	"link-local":    {"169.254.0.0/16", "fe80::/10"},
+	"documentation": {"192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24", "2001:db8::/32"},
+	"benchmarking":  {"198.18.0.0/15", "2001:2::/48"},
+	"multicast":     {"224.0.0.0/4", "ff00::/8"},
+	"reserved":      {"192.0.0.0/24", "240.0.0.0/4"},
+})
+
+// reservedClassifier labels addresses that have no meaningful geo data
+type reservedClassifier struct {
+	custom    []labelled
+	skipRules bool
+}
+
+// newReservedClassifier returns nil when the classifier is disabled
+func newReservedClassifier(cfg Reserved) (*reservedClassifier, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	c := &reservedClassifier{skipRules: cfg.SkipRules}
+	for _, n := range cfg.Networks {
+		prefix, err := netip.ParsePrefix(n.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reserved network `%s`: %s", n.CIDR, err)
+		}
+		if n.Label == "" {
+			return nil, fmt.Errorf("reserved network `%s` needs a label", n.CIDR)
+		}
+		c.custom = append(c.custom, labelled{prefix.Masked(), n.Label})
+	}
+	return c, nil
+}
+
+// classify returns the label of a reserved or internal address
+func (c *reservedClassifier) classify(ipStr string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+
+	addr, err := netip.ParseAddr(ipStr)
+	if err != nil {
+		return "", false
+	}
+	addr = addr.Unmap()
+
+	if label, ok := longestMatch(c.custom, addr); ok {
+		return label, true
+	}
+	return longestMatch(reservedRanges, addr)
+}
+
+// longestMatch returns the label of the most specific network containing addr
+func longestMatch(networks []labelled, addr netip.Addr) (string, bool) {
+	best := -1
+	label := ""
+	for _, n := range networks {
+		if n.prefix.Bits() > best && n.prefix.Contains(addr) {
+			best = n.prefix.Bits()
+			label = n.label
+		}
+	}
+	return label, best >= 0
+}
+
+func mustLabelled(ranges map[string][]string) []labelled {
+	var networks []labelled
+	for label, cidrs := range ranges {
+		for _, cidr := range cidrs {
+			networks = append(networks, labelled{netip.MustParsePrefix(cidr), label})
+		}
+	}
+	return networks
+}
@@ -0,0 +1,66 @@
+package traefik_ip2region
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReservedClassify(t *testing.T) {
+	c, err := newReservedClassifier(Reserved{
+		Enabled:  true,
+		Networks: []InternalNetwork{{CIDR: "10.1.0.0/16", Label: "office-hangzhou"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"10.1.2.3":        "office-hangzhou",
+		"10.2.0.1":        "private",
+		"192.168.1.1":     "private",
+		"100.64.1.1":      "cgnat",
+		"127.0.0.1":       "loopback",
+		"::1":             "loopback",
+		"169.254.1.1":     "link-local",
+		"fe80::1":         "link-local",
+		"203.0.113.9":     "documentation",
+		"::ffff:10.0.0.1": "private",
+	}
+	for ip, expected := range tests {
+		if label, ok := c.classify(ip); !ok || label != expected {
+			t.Errorf("classify(%s) = %s, want %s", ip, label, expected)
+		}
+	}
+
+	if label, ok := c.classify("1.1.1.1"); ok {
+		t.Errorf("public address classified as %s", label)
+	}
+}
+
+func TestReservedSkipRules(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DBPath = writeTestXdb(t, testRanges)
+	cfg.Whitelist.Enabled = true
+	cfg.Whitelist.Country = []string{"中国"}
+	cfg.Reserved.Enabled = true
+	cfg.Reserved.SkipRules = true
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := New(context.Background(), next, cfg, "demo-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.(*TraefikIp2Region).Close()
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "192.168.1.10:9999"
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Result().StatusCode == http.StatusForbidden {
+		t.Errorf("invalid status code: %d", recorder.Result().StatusCode)
+	}
+	assertHeader(t, req, "X-Ip2region-Country", "private")
+}
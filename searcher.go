@@ -0,0 +1,283 @@
+package traefik_ip2region
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/lionsoul2014/ip2region/binding/golang/xdb"
+)
+
+// cache policies, how much of the xdb file is kept in memory
+const (
+	cachePolicyContent     = "content"
+	cachePolicyVectorIndex = "vectorIndex"
+	cachePolicyFile        = "file"
+)
+
+// defaultPoolSize bounds the file backed searchers of one database
+const defaultPoolSize = 16
+
+// ipSearcher looks up the region string of an address, also returns the io count
+type ipSearcher interface {
+	search(ip string) (string, int, error)
+	Close()
+}
+
+// regionLister enumerates every distinct region string of a database
+type regionLister interface {
+	regions(fn func(region string)) error
+}
+
+// contentSearcher a searcher over the whole file cached in memory.
+// xdb.Searcher records the io count of every search, so each lookup gets its
+// own cheap searcher over the shared buffer to stay safe for concurrent use.
+type contentSearcher struct {
+	cBuff []byte
+}
+
+func (s contentSearcher) search(ip string) (string, int, error) {
+	searcher, err := xdb.NewWithBuffer(s.cBuff)
+	if err != nil {
+		return "", 0, err
+	}
+
+	region, err := searcher.SearchByStr(ip)
+	return region, 0, err
+}
+
+// Close nothing to release for a buffer based searcher
+func (s contentSearcher) Close() {}
+
+func (s contentSearcher) regions(fn func(region string)) error {
+	return walkXdbRegions(bytes.NewReader(s.cBuff), int64(len(s.cBuff)), fn)
+}
+
+// searcherPool hands out file backed searchers, which are not safe for concurrent use.
+// A lookup waits when every searcher is busy.
+type searcherPool struct {
+	path      string
+	searchers chan *xdb.Searcher
+}
+
+func newSearcherPool(path string, size int, create func() (*xdb.Searcher, error)) (*searcherPool, error) {
+	p := &searcherPool{path: path, searchers: make(chan *xdb.Searcher, size)}
+	for i := 0; i < size; i++ {
+		s, err := create()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.searchers <- s
+	}
+	return p, nil
+}
+
+func (p *searcherPool) search(ip string) (string, int, error) {
+	s := <-p.searchers
+	defer func() { p.searchers <- s }()
+
+	region, err := s.SearchByStr(ip)
+	return region, s.GetIOCount(), err
+}
+
+// regions reads the file once more, the pooled searchers are left alone
+func (p *searcherPool) regions(fn func(region string)) error {
+	handle, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	fi, err := handle.Stat()
+	if err != nil {
+		return err
+	}
+	return walkXdbRegions(handle, fi.Size(), fn)
+}
+
+// Close closes the idle searchers, it must not race with search
+func (p *searcherPool) Close() {
+	for {
+		select {
+		case s := <-p.searchers:
+			s.Close()
+		default:
+			return
+		}
+	}
+}
+
+func loadXdb(dbPath, cachePolicy string, poolSize int) (ipSearcher, *xdbHeader, error) {
+	switch cachePolicy {
+	case "", cachePolicyContent:
+		return loadXdbContent(dbPath)
+	case cachePolicyVectorIndex, cachePolicyFile:
+		return loadXdbFile(dbPath, cachePolicy, poolSize)
+	default:
+		return nil, nil, fmt.Errorf("unknown cachePolicy `%s`", cachePolicy)
+	}
+}
+
+// loadXdbContent keeps the whole file in memory
+func loadXdbContent(dbPath string) (ipSearcher, *xdbHeader, error) {
+	// 1、从 dbPath 加载整个 xdb 到内存
+	cBuff, err := xdb.LoadContentFromFile(dbPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load content from `%s`: %s", dbPath, err)
+	}
+	searcher, header, err := newContentSearcher(cBuff)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid xdb file `%s`: %s", dbPath, err)
+	}
+	return searcher, header, nil
+}
+
+// newContentSearcher validates an xdb file held in memory and creates its searcher
+func newContentSearcher(cBuff []byte) (ipSearcher, *xdbHeader, error) {
+	header, err := validateXdb(cBuff, int64(len(cBuff)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 2、用 cBuff 创建完全基于内存的查询对象。
+	if header.IPVersion == ipv6VersionNo {
+		return newV6WithBuffer(cBuff), header, nil
+	}
+	if _, err := xdb.NewWithBuffer(cBuff); err != nil {
+		return nil, nil, fmt.Errorf("failed to create searcher with content: %s", err)
+	}
+	return contentSearcher{cBuff: cBuff}, header, nil
+}
+
+// loadXdbFile reads the file on every lookup, optionally with the vector index cached
+func loadXdbFile(dbPath, cachePolicy string, poolSize int) (ipSearcher, *xdbHeader, error) {
+	handle, err := os.Open(dbPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open `%s`: %s", dbPath, err)
+	}
+
+	header, size, err := readXdbHeader(handle)
+	if err != nil {
+		_ = handle.Close()
+		return nil, nil, fmt.Errorf("invalid xdb file `%s`: %s", dbPath, err)
+	}
+
+	var vIndex []byte
+	if cachePolicy == cachePolicyVectorIndex {
+		vIndex, err = xdb.LoadVectorIndex(handle)
+		if err != nil {
+			_ = handle.Close()
+			return nil, nil, fmt.Errorf("failed to load vector index from `%s`: %s", dbPath, err)
+		}
+	}
+
+	// the IPv6 searcher reads with ReadAt and needs no pool
+	if header.IPVersion == ipv6VersionNo {
+		return newV6WithFile(handle, size, vIndex), header, nil
+	}
+	_ = handle.Close()
+
+	if poolSize <= 0 {
+		poolSize = defaultPoolSize
+	}
+	pool, err := newSearcherPool(dbPath, poolSize, func() (*xdb.Searcher, error) {
+		if vIndex != nil {
+			return xdb.NewWithVectorIndex(dbPath, vIndex)
+		}
+		return xdb.NewWithFileOnly(dbPath)
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create searcher for `%s`: %s", dbPath, err)
+	}
+	return pool, header, nil
+}
+
+// readXdbHeader validates the header of an open file and returns its size
+func readXdbHeader(handle *os.File) (*xdbHeader, int64, error) {
+	fi, err := handle.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	buff := make([]byte, xdb.HeaderInfoLength)
+	if _, err := handle.ReadAt(buff, 0); err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+
+	header, err := validateXdb(buff, fi.Size())
+	if err != nil {
+		return nil, 0, err
+	}
+	return header, fi.Size(), nil
+}
+
+// validateXdb checks that the header of a file of the given size looks like an xdb file the searcher can read
+func validateXdb(headerBuff []byte, size int64) (*xdbHeader, error) {
+	if size < int64(xdb.HeaderInfoLength+xdb.VectorIndexRows*xdb.VectorIndexCols*xdb.VectorIndexSize) {
+		return nil, fmt.Errorf("file too small: %d bytes", size)
+	}
+
+	header, err := parseXdbHeader(headerBuff)
+	if err != nil {
+		return nil, err
+	}
+
+	if int(header.StartIndexPtr) < xdb.HeaderInfoLength || header.StartIndexPtr > header.EndIndexPtr ||
+		int64(header.EndIndexPtr)+int64(header.segmentIndexSize()) > size {
+		return nil, fmt.Errorf("invalid index pointers %d-%d", header.StartIndexPtr, header.EndIndexPtr)
+	}
+	return header, nil
+}
+
+// walkXdbBlocks segment index blocks read at once by walkXdbRegions
+const walkXdbBlocks = 4096
+
+// walkXdbRegions calls fn once for every distinct region of an IPv4 or IPv6 xdb file
+func walkXdbRegions(r io.ReaderAt, size int64, fn func(region string)) error {
+	headerBuff := make([]byte, xdb.HeaderInfoLength)
+	if _, err := r.ReadAt(headerBuff, 0); err != nil && err != io.EOF {
+		return err
+	}
+	header, err := validateXdb(headerBuff, size)
+	if err != nil {
+		return err
+	}
+
+	blockSize := int64(header.segmentIndexSize())
+	// dataLen and dataPtr follow the start and end address
+	lenOffset := blockSize - 6
+
+	seen := map[uint32]bool{}
+	end := int64(header.EndIndexPtr) + blockSize
+	buff := make([]byte, walkXdbBlocks*blockSize)
+	for offset := int64(header.StartIndexPtr); offset < end; offset += int64(len(buff)) {
+		if end-offset < int64(len(buff)) {
+			buff = buff[:end-offset]
+		}
+		if _, err := r.ReadAt(buff, offset); err != nil && err != io.EOF {
+			return err
+		}
+
+		for b := int64(0); b+blockSize <= int64(len(buff)); b += blockSize {
+			dataLen := int64(binary.LittleEndian.Uint16(buff[b+lenOffset:]))
+			dataPtr := binary.LittleEndian.Uint32(buff[b+lenOffset+2:])
+			if dataLen == 0 || seen[dataPtr] {
+				continue
+			}
+			seen[dataPtr] = true
+
+			if int64(dataPtr)+dataLen > size {
+				return fmt.Errorf("region at %d outside the file", dataPtr)
+			}
+			region := make([]byte, dataLen)
+			if _, err := r.ReadAt(region, int64(dataPtr)); err != nil && err != io.EOF {
+				return err
+			}
+			fn(string(region))
+		}
+	}
+	return nil
+}
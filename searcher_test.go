@@ -0,0 +1,57 @@
+package traefik_ip2region
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestCachePolicies(t *testing.T) {
+	path := writeTestXdb(t, testRanges)
+	pathV6 := writeTestXdbV6(t, testRangesV6)
+
+	for _, policy := range []string{cachePolicyContent, cachePolicyVectorIndex, cachePolicyFile} {
+		s, _, err := loadXdb(path, policy, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// file backed searchers are pooled, concurrent lookups must not interfere
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					region, ioCount, err := s.search("223.5.5.5")
+					if err != nil || region != "中国|0|浙江省|杭州市|阿里云" {
+						t.Errorf("%s: invalid region %s: %v", policy, region, err)
+						return
+					}
+					if (policy == cachePolicyContent) != (ioCount == 0) {
+						t.Errorf("%s: unexpected io count %d", policy, ioCount)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		s.Close()
+
+		s6, _, err := loadXdb(pathV6, policy, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		region, ioCount, err := s6.search("240e::1")
+		if err != nil || region != "中国|0|广东省|广州市|电信" {
+			t.Errorf("%s: invalid IPv6 region %s: %v", policy, region, err)
+		}
+		if (policy == cachePolicyContent) != (ioCount == 0) {
+			t.Errorf("%s: unexpected IPv6 io count %d", policy, ioCount)
+		}
+		s6.Close()
+	}
+
+	if _, _, err := loadXdb(path, "mmap", 0); err == nil {
+		t.Error("expected an error for an unknown cache policy")
+	}
+}
@@ -0,0 +1,135 @@
+package traefik_ip2region
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// dbStatus the metadata of one database as reported by the status endpoint
+type dbStatus struct {
+	Path        string     `json:"path"`
+	Loaded      bool       `json:"loaded"`
+	Version     int        `json:"version"`
+	LoadedAt    *time.Time `json:"loadedAt,omitempty"`
+	Format      string     `json:"format,omitempty"`
+	XdbVersion  int        `json:"xdbVersion,omitempty"`
+	MmdbVersion int        `json:"mmdbVersion,omitempty"`
+	IPVersion   int        `json:"ipVersion,omitempty"`
+	IndexPolicy string     `json:"indexPolicy,omitempty"`
+	Type        string     `json:"type,omitempty"`
+	CreatedAt   *time.Time `json:"createdAt,omitempty"`
+	Stale       bool       `json:"stale"`
+}
+
+// pluginStatus the body of the status endpoint
+type pluginStatus struct {
+	Name       string     `json:"name"`
+	Degraded   bool       `json:"degraded"`
+	InvalidIPs uint64     `json:"invalidIps"`
+	Databases  []dbStatus `json:"databases"`
+	// Cache the lookup cache counters, omitted when the cache is disabled
+	Cache *cacheStats `json:"cache,omitempty"`
+}
+
+// staleness reports databases older than maxAge, the warning is logged by the database itself
+type staleness struct {
+	maxAge time.Duration
+}
+
+func newStaleness(maxAge string) (*staleness, error) {
+	if maxAge == "" {
+		return &staleness{}, nil
+	}
+
+	d, err := time.ParseDuration(maxAge)
+	if err != nil {
+		return nil, fmt.Errorf("invalid maxDbAge `%s`: %s", maxAge, err)
+	}
+	return &staleness{maxAge: d}, nil
+}
+
+// stale reports whether the database was built more than maxAge ago
+func (s *staleness) stale(info dbInfo) bool {
+	return isStale(info.Meta, s.maxAge)
+}
+
+// isStale reports whether meta was built more than maxAge ago, never with maxAge 0
+func isStale(meta *dbMeta, maxAge time.Duration) bool {
+	// text sources from the configuration have no build time
+	if maxAge <= 0 || meta == nil || meta.CreatedAt.IsZero() {
+		return false
+	}
+	return time.Since(meta.CreatedAt) > maxAge
+}
+
+// dbStatuses reports every configured database
+func (a *TraefikIp2Region) dbStatuses() []dbStatus {
+	var statuses []dbStatus
+	for _, db := range []*dbEntry{a.db, a.db6} {
+		if db == nil {
+			continue
+		}
+
+		info := db.info()
+		st := dbStatus{Path: info.Path, Loaded: info.Meta != nil, Version: info.Version}
+		if info.Meta != nil {
+			loadedAt, createdAt := info.LoadedAt.UTC(), info.Meta.CreatedAt
+			st.LoadedAt = &loadedAt
+			st.Format = info.Meta.Format
+			if info.Meta.Format == dbFormatMmdb {
+				st.MmdbVersion = info.Meta.Version
+			} else {
+				st.XdbVersion = info.Meta.Version
+			}
+			st.IPVersion = info.Meta.IPVersion
+			st.IndexPolicy = info.Meta.IndexPolicy
+			st.Type = info.Meta.Type
+			st.CreatedAt = &createdAt
+			st.Stale = a.staleness.stale(info)
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses
+}
+
+// serveStatus writes the status of this instance as JSON
+func (a *TraefikIp2Region) serveStatus(rw http.ResponseWriter) {
+	status := pluginStatus{
+		Name:       a.name,
+		Degraded:   a.Degraded(),
+		InvalidIPs: a.InvalidIPs(),
+		Databases:  a.dbStatuses(),
+		Cache:      a.cache.stats(),
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(rw).Encode(status); err != nil {
+		log.Printf("ip2region: failed to write status: %s", err)
+	}
+}
+
+// metadataValue describes the database of an address for the metadata response header
+func (a *TraefikIp2Region) metadataValue(db *dbEntry) string {
+	info := db.info()
+	if info.Meta == nil {
+		return "loaded=false"
+	}
+
+	// text sources have no format version
+	value := fmt.Sprintf("version=%d; format=%s; ", info.Version, info.Meta.Format)
+	if info.Meta.Version > 0 {
+		value = fmt.Sprintf("version=%d; %s=%d; ", info.Version, info.Meta.Format, info.Meta.Version)
+	}
+	if info.Meta.IndexPolicy != "" {
+		value += "policy=" + info.Meta.IndexPolicy + "; "
+	}
+	if info.Meta.Type != "" {
+		value += "type=" + info.Meta.Type + "; "
+	}
+	return value + fmt.Sprintf("createdAt=%s; stale=%t",
+		info.Meta.CreatedAt.Format(time.RFC3339), a.staleness.stale(info))
+}
@@ -0,0 +1,172 @@
+package traefik_ip2region
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// logBuffer collects log output, background goroutines may write while a test reads
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestStaleWarning(t *testing.T) {
+	logs := &logBuffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	// neither statusPath nor metadataResponseHeader
+	cfg := CreateConfig()
+	cfg.DBPath = writeTestXdb(t, testRanges)
+	cfg.MaxDBAge = "1h"
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), cfg, "demo-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := handler.(*TraefikIp2Region)
+	defer plugin.Close()
+
+	if n := strings.Count(logs.String(), "is older than 1h0m0s"); n != 1 {
+		t.Fatalf("stale database logged %d times:\n%s", n, logs.String())
+	}
+
+	// the periodic check warns once per version
+	plugin.db.checkStale()
+	if n := strings.Count(logs.String(), "is older than"); n != 1 {
+		t.Errorf("stale database logged again: %d", n)
+	}
+}
+
+func TestStatusEndpoint(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DBPath = writeTestXdb(t, testRanges)
+	cfg.StatusPath = "/.ip2region/status"
+	cfg.MaxDBAge = "1h"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		t.Error("status request reached the next handler")
+	})
+	handler, err := New(context.Background(), next, cfg, "demo-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.(*TraefikIp2Region).Close()
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/.ip2region/status", nil)
+	req.RemoteAddr = "127.0.0.1:9999"
+	handler.ServeHTTP(recorder, req)
+
+	var status pluginStatus
+	if err := json.NewDecoder(recorder.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Databases) != 1 {
+		t.Fatalf("invalid databases: %+v", status.Databases)
+	}
+
+	db := status.Databases[0]
+	if !db.Loaded || db.XdbVersion != 2 || db.IPVersion != 4 || db.IndexPolicy != "VectorIndex" {
+		t.Errorf("invalid metadata: %+v", db)
+	}
+	if db.CreatedAt == nil || db.CreatedAt.Unix() != 1700000000 {
+		t.Errorf("invalid createdAt: %v", db.CreatedAt)
+	}
+	if !db.Stale {
+		t.Error("database older than maxDbAge not reported as stale")
+	}
+}
+
+func TestStatusAllowedIPs(t *testing.T) {
+	tests := map[string]struct {
+		trustedProxies []string
+		allowedIPs     []string
+		remoteAddr     string
+		served         bool
+	}{
+		"loopback":        {nil, nil, "127.0.0.1:9999", true},
+		"public":          {nil, nil, "1.1.1.1:9999", false},
+		"trusted proxy":   {[]string{"10.0.0.0/8"}, nil, "10.0.0.1:9999", true},
+		"loopback proxy":  {[]string{"10.0.0.0/8"}, nil, "127.0.0.1:9999", false},
+		"allowed":         {[]string{"10.0.0.0/8"}, []string{"192.168.1.1"}, "192.168.1.1:9999", true},
+		"allowed, proxy":  {[]string{"10.0.0.0/8"}, []string{"192.168.1.1"}, "10.0.0.1:9999", false},
+		"allowed, mapped": {nil, []string{"192.168.1.0/24"}, "[::ffff:192.168.1.1]:9999", true},
+	}
+	for name, test := range tests {
+		cfg := CreateConfig()
+		cfg.DBPath = writeTestXdb(t, testRanges)
+		cfg.StatusPath = "/.ip2region/status"
+		cfg.TrustedProxies = test.trustedProxies
+		cfg.StatusAllowedIPs = test.allowedIPs
+
+		reached := false
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) { reached = true })
+		handler, err := New(context.Background(), next, cfg, "demo-plugin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, path := range []string{"/.ip2region/status", "/.ip2region/status/vocabulary"} {
+			reached = false
+			req := httptest.NewRequest(http.MethodGet, "http://localhost"+path, nil)
+			req.RemoteAddr = test.remoteAddr
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			if reached == test.served {
+				t.Errorf("%s: %s served: %t", name, path, !reached)
+			}
+		}
+		handler.(*TraefikIp2Region).Close()
+	}
+
+	cfg := CreateConfig()
+	cfg.DBPath = writeTestXdb(t, testRanges)
+	cfg.StatusAllowedIPs = []string{"not-an-ip"}
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "demo-plugin"); err == nil {
+		t.Error("invalid statusAllowedIps accepted")
+	}
+}
+
+func TestMetadataResponseHeader(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DBPath = writeTestXdb(t, testRanges)
+	cfg.MetadataResponseHeader = "X-Ip2region-Db"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := New(context.Background(), next, cfg, "demo-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.(*TraefikIp2Region).Close()
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "1.1.1.1:9999"
+	handler.ServeHTTP(recorder, req)
+
+	value := recorder.Header().Get("X-Ip2region-Db")
+	if !strings.Contains(value, "policy=VectorIndex") || !strings.Contains(value, "createdAt=2023-11-14T22:13:20Z") || !strings.Contains(value, "stale=false") {
+		t.Errorf("invalid metadata header: %s", value)
+	}
+}
@@ -0,0 +1,187 @@
+package traefik_ip2region
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// textSourceFields startIP|endIP|国家|区域|省份|城市|ISP
+const textSourceFields = 7
+
+// textRange one line of ip2region source data
+type textRange struct {
+	start  netip.Addr
+	end    netip.Addr
+	region string
+}
+
+// textSearcher an in-memory index over ip2region source data,
+// the ranges are sorted and do not overlap so a lookup is a binary search.
+type textSearcher struct {
+	ipVersion int
+	ranges    []textRange
+}
+
+func loadText(dbPath string) (*textSearcher, *dbMeta, error) {
+	f, err := os.Open(dbPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open `%s`: %s", dbPath, err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to stat `%s`: %s", dbPath, err)
+	}
+
+	searcher, err := parseTextSource(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid text source `%s`: %s", dbPath, err)
+	}
+
+	meta := &dbMeta{
+		Format:    dbFormatText,
+		IPVersion: searcher.ipVersion,
+		// the source has no build time, the file is as old as its last change
+		CreatedAt: fi.ModTime().UTC(),
+	}
+	return searcher, meta, nil
+}
+
+// parseTextSource reads startIP|endIP|国家|区域|省份|城市|ISP lines.
+// Empty lines and lines starting with # are skipped, all addresses must be of one family.
+func parseTextSource(r io.Reader) (*textSearcher, error) {
+	s := &textSearcher{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		rg, err := parseTextRange(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+
+		ipVersion := ipv4VersionNo
+		if rg.start.Is6() {
+			ipVersion = ipv6VersionNo
+		}
+		if s.ipVersion == 0 {
+			s.ipVersion = ipVersion
+		} else if s.ipVersion != ipVersion {
+			return nil, fmt.Errorf("line %d: IPv4 and IPv6 ranges cannot be mixed", line)
+		}
+		s.ranges = append(s.ranges, rg)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(s.ranges) == 0 {
+		return nil, fmt.Errorf("no ranges")
+	}
+
+	sort.Slice(s.ranges, func(i, j int) bool {
+		return s.ranges[i].start.Less(s.ranges[j].start)
+	})
+	for i := 1; i < len(s.ranges); i++ {
+		if prev := s.ranges[i-1]; !prev.end.Less(s.ranges[i].start) {
+			return nil, fmt.Errorf("range %s|%s overlaps %s|%s",
+				s.ranges[i].start, s.ranges[i].end, prev.start, prev.end)
+		}
+	}
+	return s, nil
+}
+
+// parseTextRange parses one startIP|endIP|国家|区域|省份|城市|ISP line
+func parseTextRange(line string) (textRange, error) {
+	parts := strings.Split(line, "|")
+	if len(parts) < textSourceFields {
+		return textRange{}, fmt.Errorf("expected %d fields, got %d", textSourceFields, len(parts))
+	}
+
+	start, err := netip.ParseAddr(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return textRange{}, fmt.Errorf("invalid start ip `%s`", parts[0])
+	}
+	end, err := netip.ParseAddr(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return textRange{}, fmt.Errorf("invalid end ip `%s`", parts[1])
+	}
+	start, end = start.Unmap(), end.Unmap()
+	if start.Is4() != end.Is4() || end.Less(start) {
+		return textRange{}, fmt.Errorf("invalid range %s|%s", start, end)
+	}
+
+	return textRange{start: start, end: end, region: strings.Join(parts[2:textSourceFields], "|")}, nil
+}
+
+func (s *textSearcher) search(ip string) (string, int, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid ip address `%s`", ip)
+	}
+	addr = addr.Unmap()
+	if addr.Is4() != (s.ipVersion == ipv4VersionNo) {
+		return "", 0, fmt.Errorf("`%s` is not an IPv%d address", ip, s.ipVersion)
+	}
+
+	// the first range ending at or after addr
+	i := sort.Search(len(s.ranges), func(i int) bool {
+		return !s.ranges[i].end.Less(addr)
+	})
+	if i < len(s.ranges) && !addr.Less(s.ranges[i].start) {
+		return s.ranges[i].region, 0, nil
+	}
+	return "", 0, nil
+}
+
+func (s *textSearcher) regions(fn func(region string)) error {
+	for _, r := range s.ranges {
+		fn(r.region)
+	}
+	return nil
+}
+
+// Close nothing to release for an in-memory index
+func (s *textSearcher) Close() {}
+
+// isTextSource reports whether the first data line of content looks like ip2region source data
+func isTextSource(content []byte) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		_, err := parseTextRange(text)
+		return err == nil
+	}
+	return false
+}
+
+// isTextFile checks the beginning of the file at path with isTextSource
+func isTextFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	buff := make([]byte, 4096)
+	n, _ := io.ReadFull(f, buff)
+	// the last line may be cut off
+	if i := bytes.LastIndexByte(buff[:n], '\n'); i > 0 && n == len(buff) {
+		n = i
+	}
+	return isTextSource(buff[:n])
+}
@@ -0,0 +1,95 @@
+package traefik_ip2region
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestText writes ranges as ip2region source data
+func writeTestText(t *testing.T, ranges []testRange) string {
+	t.Helper()
+
+	var b strings.Builder
+	b.WriteString("# curated subset\n")
+	for _, r := range ranges {
+		b.WriteString(r.start + "|" + r.end + "|" + r.region + "\n")
+	}
+
+	path := filepath.Join(t.TempDir(), "ip.merge.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTextSearch(t *testing.T) {
+	for name, ranges := range map[string][]testRange{"v4": testRanges, "v6": testRangesV6} {
+		searcher, meta, err := loadDatabase(writeTestText(t, ranges), dbOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Format != dbFormatText {
+			t.Errorf("%s: detected as %s", name, meta.Format)
+		}
+
+		for _, r := range ranges {
+			for _, ip := range []string{r.start, r.end} {
+				region, _, err := searcher.search(ip)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if region != r.region {
+					t.Errorf("%s: got %q, want %q", ip, region, r.region)
+				}
+			}
+		}
+	}
+
+	searcher, _, err := loadDatabase(writeTestText(t, testRanges), dbOptions{provider: providerText})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if region, _, err := searcher.search("9.9.9.9"); err != nil || region != "" {
+		t.Errorf("address in a gap: %q, %v", region, err)
+	}
+}
+
+func TestTextSourceInvalid(t *testing.T) {
+	tests := map[string]string{
+		"overlap": "1.0.0.0|1.0.0.255|a|0|0|0|0\n1.0.0.128|1.0.1.0|b|0|0|0|0\n",
+		"fields":  "1.0.0.0|1.0.0.255|a|0|0\n",
+		"order":   "1.0.0.255|1.0.0.0|a|0|0|0|0\n",
+		"mixed":   "1.0.0.0|1.0.0.255|a|0|0|0|0\n2001:db8::|2001:db8::ff|b|0|0|0|0\n",
+		"empty":   "# nothing\n",
+	}
+	for name, content := range tests {
+		if _, err := parseTextSource(strings.NewReader(content)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestTextServeHTTP(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DBPath = writeTestText(t, testRanges)
+	cfg.Headers.Province = "X-Ip2region-Province"
+	cfg.Headers.ISP = "X-Ip2region-Isp"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := New(context.Background(), next, cfg, "demo-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.(*TraefikIp2Region).Close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "223.5.5.5:4711"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, "X-Ip2region-Province", "浙江省")
+	assertHeader(t, req, "X-Ip2region-Isp", "阿里云")
+}
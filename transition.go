@@ -0,0 +1,55 @@
+package traefik_ip2region
+
+import (
+	"net/netip"
+)
+
+// IPv6 transition mechanisms that carry an IPv4 address
+const (
+	transitionIPv4Mapped = "ipv4-mapped"
+	transitionNAT64      = "nat64"
+	transition6to4       = "6to4"
+	transitionTeredo     = "teredo"
+)
+
+var (
+	nat64Prefix  = netip.MustParsePrefix("64:ff9b::/96")
+	sixToFour    = netip.MustParsePrefix("2002::/16")
+	teredoPrefix = netip.MustParsePrefix("2001::/32")
+)
+
+// unwrapIPv4 returns the IPv4 address embedded in an IPv6 address and the
+// transition mechanism it was found by. Any other input is returned unchanged.
+func unwrapIPv4(ipStr string) (string, string) {
+	addr, err := netip.ParseAddr(ipStr)
+	if err != nil || !addr.Is6() {
+		return ipStr, ""
+	}
+
+	if v4, mechanism, ok := embeddedIPv4(addr); ok {
+		return v4.String(), mechanism
+	}
+	return ipStr, ""
+}
+
+// embeddedIPv4 extracts the IPv4 address of mapped, NAT64, 6to4 and Teredo addresses
+func embeddedIPv4(addr netip.Addr) (netip.Addr, string, bool) {
+	addr = addr.WithZone("")
+	b := addr.As16()
+
+	switch {
+	case addr.Is4In6():
+		// ::ffff:a.b.c.d
+		return addr.Unmap(), transitionIPv4Mapped, true
+	case nat64Prefix.Contains(addr):
+		// 64:ff9b::a.b.c.d
+		return netip.AddrFrom4([4]byte{b[12], b[13], b[14], b[15]}), transitionNAT64, true
+	case sixToFour.Contains(addr):
+		// 2002:AABB:CCDD::/48
+		return netip.AddrFrom4([4]byte{b[2], b[3], b[4], b[5]}), transition6to4, true
+	case teredoPrefix.Contains(addr):
+		// 2001:0:server:flags:port:client, the client address is stored inverted
+		return netip.AddrFrom4([4]byte{^b[12], ^b[13], ^b[14], ^b[15]}), transitionTeredo, true
+	}
+	return netip.Addr{}, "", false
+}
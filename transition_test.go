@@ -0,0 +1,52 @@
+package traefik_ip2region
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUnwrapIPv4(t *testing.T) {
+	tests := []struct {
+		in        string
+		ip        string
+		mechanism string
+	}{
+		{"::ffff:1.1.1.1", "1.1.1.1", transitionIPv4Mapped},
+		{"64:ff9b::808:808", "8.8.8.8", transitionNAT64},
+		{"2002:df05:505::1", "223.5.5.5", transition6to4},
+		{"2001:0:4136:e378:8000:63bf:fefe:fefe", "1.1.1.1", transitionTeredo},
+		{"2001:db8::1", "2001:db8::1", ""},
+		{"1.1.1.1", "1.1.1.1", ""},
+		{"garbage", "garbage", ""},
+	}
+
+	for _, test := range tests {
+		ip, mechanism := unwrapIPv4(test.in)
+		if ip != test.ip || mechanism != test.mechanism {
+			t.Errorf("unwrapIPv4(%s) = %s, %s; want %s, %s", test.in, ip, mechanism, test.ip, test.mechanism)
+		}
+	}
+}
+
+func TestEmbeddedIPv4Lookup(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DBPath = writeTestXdb(t, testRanges)
+	cfg.Headers.Transition = "X-Ip2region-Transition"
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	handler, err := New(ctx, next, cfg, "demo-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.(*TraefikIp2Region).Close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "[64:ff9b::101:101]:9999"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, "X-Ip2region-Country", "澳大利亚")
+	assertHeader(t, req, "X-Ip2region-Transition", transitionNAT64)
+}
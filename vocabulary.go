@@ -0,0 +1,306 @@
+package traefik_ip2region
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// vocabularyPath is appended to the status path to serve the vocabulary
+const vocabularyPath = "/vocabulary"
+
+// maxSuggestions "did you mean" candidates per unknown value
+const maxSuggestions = 3
+
+// ruleFields the fields of 国家|区域|省份|城市|ISP the rules compare against
+var ruleFields = []struct {
+	name  string
+	index int
+	rules func(r *Rules) []string
+}{
+	{"country", 0, func(r *Rules) []string { return r.Country }},
+	{"province", 2, func(r *Rules) []string { return r.Province }},
+	{"city", 3, func(r *Rules) []string { return r.City }},
+	{"isp", 4, func(r *Rules) []string { return r.ISP }},
+}
+
+// vocabulary the distinct values of every field of 国家|区域|省份|城市|ISP
+type vocabulary struct {
+	values []map[string]struct{}
+}
+
+func newVocabulary() *vocabulary {
+	v := &vocabulary{values: make([]map[string]struct{}, len(geoFieldNames))}
+	for i := range v.values {
+		v.values[i] = map[string]struct{}{}
+	}
+	return v
+}
+
+// addRegion adds the known values of a 国家|区域|省份|城市|ISP string
+func (v *vocabulary) addRegion(region string) {
+	v.addData(strings.Split(region, "|"))
+}
+
+func (v *vocabulary) addData(data []string) {
+	for i, value := range data {
+		if i < len(v.values) && knownValue(value) {
+			v.values[i][value] = struct{}{}
+		}
+	}
+}
+
+func (v *vocabulary) merge(o *vocabulary) {
+	for i := range v.values {
+		for value := range o.values[i] {
+			v.values[i][value] = struct{}{}
+		}
+	}
+}
+
+func (v *vocabulary) has(field int, value string) bool {
+	_, ok := v.values[field][value]
+	return ok
+}
+
+func (v *vocabulary) sorted(field int) []string {
+	values := make([]string, 0, len(v.values[field]))
+	for value := range v.values[field] {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return values
+}
+
+// suggest returns the known values closest to an unknown one: case-insensitive
+// matches first, then values containing it or contained in it, then small edit distances
+func (v *vocabulary) suggest(field int, value string) []string {
+	type candidate struct {
+		value string
+		score int
+	}
+
+	lower := strings.ToLower(value)
+	maxDistance := utf8.RuneCountInString(value) / 3
+	if maxDistance < 1 {
+		maxDistance = 1
+	}
+
+	var candidates []candidate
+	for known := range v.values[field] {
+		kl := strings.ToLower(known)
+		score := -1
+		switch {
+		case kl == lower:
+			score = 0
+		case strings.HasPrefix(kl, lower) || strings.HasPrefix(lower, kl):
+			score = 1
+		case strings.Contains(kl, lower) || strings.Contains(lower, kl):
+			score = 2
+		default:
+			if d := levenshtein(lower, kl); d <= maxDistance {
+				score = 2 + d
+			}
+		}
+		if score >= 0 {
+			candidates = append(candidates, candidate{known, score})
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score < candidates[j].score
+		}
+		return candidates[i].value < candidates[j].value
+	})
+	var suggestions []string
+	for i := 0; i < len(candidates) && i < maxSuggestions; i++ {
+		suggestions = append(suggestions, candidates[i].value)
+	}
+	return suggestions
+}
+
+// levenshtein the edit distance of a and b in runes
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if d := prev[j] + 1; d < cur[j] {
+				cur[j] = d
+			}
+			if d := cur[j-1] + 1; d < cur[j] {
+				cur[j] = d
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// vocabulary lists the distinct values of the loaded database, cached per version
+func (e *dbEntry) vocabulary() (*vocabulary, error) {
+	e.mu.RLock()
+	searcher, version := e.searcher, e.version
+	if e.vocab != nil && e.vocabVersion == version {
+		defer e.mu.RUnlock()
+		return e.vocab, nil
+	}
+	e.mu.RUnlock()
+
+	if searcher == nil {
+		return nil, fmt.Errorf("database `%s` is not loaded", e.path)
+	}
+	lister, ok := searcher.(regionLister)
+	if !ok {
+		return nil, fmt.Errorf("database `%s` cannot list its values", e.path)
+	}
+
+	// walked without the lock, a reload must not wait for it
+	v := newVocabulary()
+	if err := lister.regions(v.addRegion); err != nil {
+		return nil, fmt.Errorf("failed to list the values of `%s`: %s", e.path, err)
+	}
+
+	e.mu.Lock()
+	if e.version == version {
+		e.vocab, e.vocabVersion = v, version
+	}
+	e.mu.Unlock()
+	return v, nil
+}
+
+// values adds the values of every overlay entry
+func (o *overlay) values(v *vocabulary) {
+	if o == nil {
+		return
+	}
+
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	for _, data := range o.entries {
+		v.addData(data)
+	}
+}
+
+// labels the values the classifier puts into the country field
+func (c *reservedClassifier) labels(v *vocabulary) {
+	if c == nil {
+		return
+	}
+	for _, networks := range [][]labelled{reservedRanges, c.custom} {
+		for _, n := range networks {
+			v.addData([]string{n.label})
+		}
+	}
+}
+
+// vocabulary merges the values of every database, overlay and reserved label of this instance
+func (a *TraefikIp2Region) vocabulary() (*vocabulary, error) {
+	v := newVocabulary()
+
+	dbs := []*dbEntry{a.db, a.db6}
+	for _, p := range a.providers {
+		dbs = append(dbs, p.db)
+		p.overlay.values(v)
+	}
+	for _, db := range dbs {
+		if db == nil {
+			continue
+		}
+		dv, err := db.vocabulary()
+		if err != nil {
+			return nil, err
+		}
+		v.merge(dv)
+	}
+
+	a.overlay.values(v)
+	a.reserved.labels(v)
+	return v, nil
+}
+
+// validateRules checks every value of the enabled ban and whitelist rules against the
+// vocabulary. Unknown values are logged with suggestions, strict makes them an error.
+func (a *TraefikIp2Region) validateRules(strict bool) error {
+	if !a.ban.Enabled && !a.whitelist.Enabled {
+		return nil
+	}
+	if a.Degraded() {
+		log.Printf("ip2region: rules not validated, the database is not loaded yet")
+		return nil
+	}
+
+	v, err := a.vocabulary()
+	if err != nil {
+		if strict {
+			return fmt.Errorf("cannot validate the rules: %s", err)
+		}
+		log.Printf("ip2region: rules not validated: %s", err)
+		return nil
+	}
+
+	var unknown []string
+	for _, rules := range []struct {
+		name  string
+		rules *Rules
+	}{{"ban", &a.ban}, {"whitelist", &a.whitelist}} {
+		if !rules.rules.Enabled {
+			continue
+		}
+		for _, f := range ruleFields {
+			for _, value := range f.rules(rules.rules) {
+				if v.has(f.index, value) {
+					continue
+				}
+
+				msg := fmt.Sprintf("%s.%s `%s` is not in the database", rules.name, f.name, value)
+				if suggestions := v.suggest(f.index, value); len(suggestions) > 0 {
+					msg += fmt.Sprintf(", did you mean `%s`?", strings.Join(suggestions, "`, `"))
+				}
+				log.Printf("ip2region: %s", msg)
+				unknown = append(unknown, msg)
+			}
+		}
+	}
+
+	if strict && len(unknown) > 0 {
+		return fmt.Errorf("unknown rule values: %s", strings.Join(unknown, "; "))
+	}
+	return nil
+}
+
+// serveVocabulary writes the distinct values of every rule field as JSON
+func (a *TraefikIp2Region) serveVocabulary(rw http.ResponseWriter) {
+	v, err := a.vocabulary()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	body := map[string][]string{}
+	for _, f := range ruleFields {
+		body[f.name] = v.sorted(f.index)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(rw).Encode(body); err != nil {
+		log.Printf("ip2region: failed to write vocabulary: %s", err)
+	}
+}
@@ -0,0 +1,144 @@
+package traefik_ip2region
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVocabulary(t *testing.T) {
+	tests := map[string]struct {
+		path   string
+		opts   dbOptions
+		cities []string
+	}{
+		"content":     {writeTestXdb(t, testRanges), dbOptions{}, []string{"北京市", "杭州市"}},
+		"vectorIndex": {writeTestXdb(t, testRanges), dbOptions{cachePolicy: cachePolicyVectorIndex}, []string{"北京市", "杭州市"}},
+		"file":        {writeTestXdb(t, testRanges), dbOptions{cachePolicy: cachePolicyFile, poolSize: 1}, []string{"北京市", "杭州市"}},
+		"v6":          {writeTestXdbV6(t, testRangesV6), dbOptions{}, []string{"东京", "广州市"}},
+		"text":        {writeTestText(t, testRanges), dbOptions{}, []string{"北京市", "杭州市"}},
+		"mmdb":        {writeTestMmdb(t, testMmdbRecords), dbOptions{}, []string{"Brisbane", "Frankfurt am Main"}},
+	}
+	for name, test := range tests {
+		searcher, _, err := loadDatabase(test.path, test.opts)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		v := newVocabulary()
+		if err := searcher.(regionLister).regions(v.addRegion); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if cities := v.sorted(3); !reflect.DeepEqual(cities, test.cities) {
+			t.Errorf("%s: got cities %v, want %v", name, cities, test.cities)
+		}
+		if v.has(3, "0") || v.has(3, "") {
+			t.Errorf("%s: unknown values listed", name)
+		}
+		searcher.Close()
+	}
+}
+
+func TestVocabularySuggest(t *testing.T) {
+	v := newVocabulary()
+	for _, r := range testRanges {
+		v.addRegion(r.region)
+	}
+	v.addRegion("Australia|0|Queensland|Brisbane|0")
+	v.addRegion("United States|0|0|0|Google LLC")
+
+	tests := map[string]struct {
+		field    int
+		value    string
+		expected []string
+	}{
+		"prefix":   {3, "杭州", []string{"杭州市"}},
+		"case":     {0, "australia", []string{"Australia"}},
+		"typo":     {3, "Brisbain", []string{"Brisbane"}},
+		"contains": {4, "Google", []string{"Google LLC"}},
+		"none":     {3, "Shenzhen", nil},
+	}
+	for name, test := range tests {
+		if suggestions := v.suggest(test.field, test.value); !reflect.DeepEqual(suggestions, test.expected) {
+			t.Errorf("%s: got %v, want %v", name, suggestions, test.expected)
+		}
+	}
+}
+
+func TestStrictRules(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	for _, strict := range []bool{false, true} {
+		cfg := CreateConfig()
+		cfg.DBPath = writeTestXdb(t, testRanges)
+		cfg.Ban.Enabled = true
+		cfg.Ban.Country = []string{"美国"}
+		cfg.Ban.City = []string{"杭州"}
+		cfg.StrictRules = strict
+
+		handler, err := New(context.Background(), next, cfg, "demo-plugin")
+		if !strict {
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler.(*TraefikIp2Region).Close()
+			continue
+		}
+		if err == nil {
+			t.Fatal("unknown city accepted in strict mode")
+		}
+		if msg := err.Error(); !strings.Contains(msg, "ban.city `杭州`") || !strings.Contains(msg, "did you mean `杭州市`") {
+			t.Errorf("invalid error: %s", msg)
+		}
+		if strings.Contains(err.Error(), "美国") {
+			t.Errorf("known country reported: %s", err)
+		}
+	}
+
+	// reserved labels are known values too
+	cfg := CreateConfig()
+	cfg.DBPath = writeTestXdb(t, testRanges)
+	cfg.Reserved.Enabled = true
+	cfg.Whitelist.Enabled = true
+	cfg.Whitelist.Country = []string{"中国", "private"}
+	cfg.StrictRules = true
+	handler, err := New(context.Background(), next, cfg, "demo-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.(*TraefikIp2Region).Close()
+}
+
+func TestVocabularyEndpoint(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DBPath = writeTestXdb(t, testRanges)
+	cfg.StatusPath = "/.ip2region/status"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		t.Error("vocabulary request reached the next handler")
+	})
+	handler, err := New(context.Background(), next, cfg, "demo-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.(*TraefikIp2Region).Close()
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/.ip2region/status/vocabulary", nil)
+	req.RemoteAddr = "127.0.0.1:9999"
+	handler.ServeHTTP(recorder, req)
+
+	var body map[string][]string
+	if err := json.NewDecoder(recorder.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(body["country"], []string{"中国", "澳大利亚", "美国"}) {
+		t.Errorf("invalid countries: %v", body["country"])
+	}
+	if !reflect.DeepEqual(body["isp"], []string{"Level3", "电信", "阿里云"}) {
+		t.Errorf("invalid isps: %v", body["isp"])
+	}
+}
@@ -0,0 +1,184 @@
+package traefik_ip2region
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+	"time"
+
+	"github.com/lionsoul2014/ip2region/binding/golang/xdb"
+)
+
+// ip2region v3 xdb layout
+const (
+	xdbStructure20 = 2
+	xdbStructure30 = 3
+
+	ipv4VersionNo = 4
+	ipv6VersionNo = 6
+
+	ipv6SegmentIndexBlockSize = 38
+)
+
+// xdbHeader the fields of the xdb header the plugin relies on
+type xdbHeader struct {
+	*xdb.Header
+	// 4 or 6, v2 files are always IPv4
+	IPVersion int
+}
+
+// parseXdbHeader reads the header of a v2 or v3 xdb file
+func parseXdbHeader(cBuff []byte) (*xdbHeader, error) {
+	if len(cBuff) < xdb.HeaderInfoLength {
+		return nil, fmt.Errorf("file too small: %d bytes", len(cBuff))
+	}
+
+	header, err := xdb.NewHeader(cBuff[:xdb.HeaderInfoLength])
+	if err != nil {
+		return nil, err
+	}
+
+	switch header.Version {
+	case xdbStructure20:
+		return &xdbHeader{Header: header, IPVersion: ipv4VersionNo}, nil
+	case xdbStructure30:
+		ipVersion := int(binary.LittleEndian.Uint16(cBuff[16:]))
+		if ipVersion != ipv4VersionNo && ipVersion != ipv6VersionNo {
+			return nil, fmt.Errorf("unsupported ip version %d", ipVersion)
+		}
+		return &xdbHeader{Header: header, IPVersion: ipVersion}, nil
+	default:
+		return nil, fmt.Errorf("unsupported xdb structure version %d", header.Version)
+	}
+}
+
+// createdAt the build time of the file
+func (h *xdbHeader) createdAt() time.Time {
+	return time.Unix(int64(h.CreatedAt), 0).UTC()
+}
+
+// segmentIndexSize returns the size of one segment index block
+func (h *xdbHeader) segmentIndexSize() int {
+	if h.IPVersion == ipv6VersionNo {
+		return ipv6SegmentIndexBlockSize
+	}
+	return xdb.SegmentIndexBlockSize
+}
+
+// xdbV6Searcher searches an IPv6 xdb file, either cached in memory or read from disk.
+// IPv4 files, v2 and v3 alike, are handled by xdb.Searcher.
+// Reads go through io.ReaderAt, so a searcher is safe for concurrent use.
+type xdbV6Searcher struct {
+	r    io.ReaderAt
+	size int64
+	// counts reads as io, false for the content buffer
+	fileBacked bool
+	// optional, preloaded vector index
+	vectorIndex []byte
+	closer      io.Closer
+}
+
+func newV6WithBuffer(cBuff []byte) *xdbV6Searcher {
+	return &xdbV6Searcher{r: bytes.NewReader(cBuff), size: int64(len(cBuff))}
+}
+
+// newV6WithFile reads from the open file, vIndex may be nil
+func newV6WithFile(handle readerAtCloser, size int64, vIndex []byte) *xdbV6Searcher {
+	return &xdbV6Searcher{r: handle, size: size, fileBacked: true, vectorIndex: vIndex, closer: handle}
+}
+
+// readerAtCloser an open xdb file
+type readerAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// Close releases the file handle if any
+func (s *xdbV6Searcher) Close() {
+	if s.closer != nil {
+		_ = s.closer.Close()
+	}
+}
+
+func (s *xdbV6Searcher) regions(fn func(region string)) error {
+	return walkXdbRegions(s.r, s.size, fn)
+}
+
+// search find the region for the specified IPv6 string
+func (s *xdbV6Searcher) search(str string) (string, int, error) {
+	addr, err := netip.ParseAddr(str)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid ip address `%s`", str)
+	}
+	if !addr.Is6() || addr.Is4In6() {
+		return "", 0, fmt.Errorf("not an IPv6 address `%s`", str)
+	}
+
+	return s.Search(addr.As16())
+}
+
+// Search find the region for the specified address, also returns the io count
+func (s *xdbV6Searcher) Search(ip [16]byte) (string, int, error) {
+	ioCount := 0
+
+	// locate the segment index block based on the vector index
+	idx := int(ip[0])*xdb.VectorIndexCols*xdb.VectorIndexSize + int(ip[1])*xdb.VectorIndexSize
+	var vBuff []byte
+	if s.vectorIndex != nil {
+		vBuff = s.vectorIndex[idx : idx+xdb.VectorIndexSize]
+	} else {
+		vBuff = make([]byte, xdb.VectorIndexSize)
+		if err := s.read(int64(xdb.HeaderInfoLength+idx), vBuff, &ioCount); err != nil {
+			return "", ioCount, fmt.Errorf("read vector index block at %d: %w", xdb.HeaderInfoLength+idx, err)
+		}
+	}
+	sPtr := binary.LittleEndian.Uint32(vBuff)
+	ePtr := binary.LittleEndian.Uint32(vBuff[4:])
+
+	// binary search the segment index, addresses are stored big endian
+	var dataLen, dataPtr = 0, uint32(0)
+	var buff = make([]byte, ipv6SegmentIndexBlockSize)
+	var l, h = 0, int((ePtr - sPtr) / ipv6SegmentIndexBlockSize)
+	for l <= h {
+		m := (l + h) >> 1
+		p := int64(sPtr) + int64(m*ipv6SegmentIndexBlockSize)
+		if err := s.read(p, buff, &ioCount); err != nil {
+			return "", ioCount, fmt.Errorf("read segment index at %d: %w", p, err)
+		}
+
+		if bytes.Compare(ip[:], buff[0:16]) < 0 {
+			h = m - 1
+		} else if bytes.Compare(ip[:], buff[16:32]) > 0 {
+			l = m + 1
+		} else {
+			dataLen = int(binary.LittleEndian.Uint16(buff[32:]))
+			dataPtr = binary.LittleEndian.Uint32(buff[34:])
+			break
+		}
+	}
+
+	if dataLen == 0 {
+		return "", ioCount, nil
+	}
+
+	regionBuff := make([]byte, dataLen)
+	if err := s.read(int64(dataPtr), regionBuff, &ioCount); err != nil {
+		return "", ioCount, fmt.Errorf("read region at %d: %w", dataPtr, err)
+	}
+	return string(regionBuff), ioCount, nil
+}
+
+// read fills buff from offset, bounded by the file size
+func (s *xdbV6Searcher) read(offset int64, buff []byte, ioCount *int) error {
+	if offset < 0 || offset+int64(len(buff)) > s.size {
+		return fmt.Errorf("offset %d out of range", offset)
+	}
+	if s.fileBacked {
+		*ioCount++
+	}
+
+	_, err := s.r.ReadAt(buff, offset)
+	return err
+}
@@ -0,0 +1,103 @@
+package traefik_ip2region
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var testRangesV6 = []testRange{
+	{"2001:db8::", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", "日本|0|东京都|东京|0"},
+	{"240e::", "240e:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "中国|0|广东省|广州市|电信"},
+}
+
+func TestIPv6Lookup(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DBPath = writeTestXdb(t, testRanges)
+	cfg.DBPathV6 = writeTestXdbV6(t, testRangesV6)
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	handler, err := New(ctx, next, cfg, "demo-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.(*TraefikIp2Region).Close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "[240e:1:2::3]:9999"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, "X-Ip2region-Country", "中国")
+	assertHeader(t, req, "X-Ip2region-City", "广州市")
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "1.1.1.1:9999"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, "X-Ip2region-Country", "澳大利亚")
+}
+
+func TestIPv6DBVersionHeader(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DBPath = writeTestXdb(t, testRanges)
+	cfg.DBPathV6 = writeTestXdbV6(t, testRangesV6)
+	cfg.Headers.DBVersion = "X-Ip2region-Db-Version"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := New(context.Background(), next, cfg, "demo-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := handler.(*TraefikIp2Region)
+	defer plugin.Close()
+
+	// the IPv6 database is one version ahead
+	if err := plugin.db6.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	for remoteAddr, version := range map[string]string{"[240e:1:2::3]:9999": "2", "1.1.1.1:9999": "1"} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = remoteAddr
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, "X-Ip2region-Db-Version", version)
+	}
+}
+
+func TestIPv6Ban(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DBPath = writeTestXdb(t, testRanges)
+	cfg.DBPathV6 = writeTestXdbV6(t, testRangesV6)
+	cfg.Ban.Enabled = true
+	cfg.Ban.Country = []string{"日本"}
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	handler, err := New(ctx, next, cfg, "demo-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.(*TraefikIp2Region).Close()
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "[2001:db8::1]:9999"
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Result().StatusCode != http.StatusForbidden {
+		t.Errorf("invalid status code: %d", recorder.Result().StatusCode)
+	}
+}
+
+func TestIPv6WrongDatabase(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DBPath = writeTestXdb(t, testRanges)
+	cfg.DBPathV6 = cfg.DBPath
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	if _, err := New(context.Background(), next, cfg, "demo-plugin"); err == nil {
+		t.Fatal("expected an error for an IPv4 file in dbPathV6")
+	}
+}